@@ -0,0 +1,291 @@
+// Package balancer defines the pluggable load balancing qrpc's client
+// uses to pick a connection for each outgoing call among the addresses a
+// resolver.Resolver has produced, modeled on grpc-go's balancer package.
+//
+// It deliberately doesn't import qrpc's root package (which imports
+// balancer to wire it in), so Cmd here is balancer's own lightweight copy
+// of qrpc.Cmd rather than a type alias.
+package balancer
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Cmd mirrors qrpc.Cmd so a Picker can make decisions based on it without
+// this package depending on qrpc's root package.
+type Cmd uint32
+
+// PickInfo is what a Picker sees about the call it's picking a SubConn
+// for.
+type PickInfo struct {
+	Cmd       Cmd
+	RequestID uint64
+	Header    map[string]string
+}
+
+// SubConn is an opaque handle a Balancer uses to refer to one of its
+// ClientConn's connections. The concrete type is owned by the ClientConn
+// implementation (qrpc.ClientConn); balancers never look inside it.
+type SubConn interface {
+	// Connect asks the owning ClientConn to (re)establish this SubConn's
+	// underlying connection if it isn't already connecting/connected.
+	Connect()
+}
+
+// SubConnState reports a SubConn's latest health transition.
+type SubConnState struct {
+	Ready bool
+	Err   error
+	// Weight is the relative share of traffic this SubConn should get,
+	// as carried through from the resolver.Address.Metadata it was
+	// created with (see qrpc.ClientConn.NewSubConn). Ignored by balancers
+	// that don't weight picks; treated as 1 if <= 0.
+	Weight int
+}
+
+// DoneInfo is passed to a PickResult's Done callback once the RPC the
+// pick was for has finished, so balancers like weighted_least_pending can
+// release per-pick accounting.
+type DoneInfo struct {
+	Err error
+}
+
+// PickResult is what a Picker returns for a successful pick.
+type PickResult struct {
+	SubConn SubConn
+	// Done, if non-nil, is invoked once the call finishes.
+	Done func(DoneInfo)
+}
+
+// ErrNoSubConnAvailable is returned by a Picker when no SubConn is
+// currently usable; the caller should wait for the next UpdateState.
+var ErrNoSubConnAvailable = errors.New("balancer: no SubConn is currently available")
+
+// Picker picks a SubConn for each outgoing call.
+type Picker interface {
+	Pick(PickInfo) (PickResult, error)
+}
+
+// ClientConn is the subset of qrpc.ClientConn a Balancer needs: creating/
+// removing SubConns and publishing the Picker built from their current
+// state.
+type ClientConn interface {
+	// NewSubConn creates a SubConn for addr. metadata is the
+	// resolver.Address.Metadata the resolver attached to addr (e.g. a
+	// weight), passed through opaquely for the Balancer/SubConnState to
+	// interpret.
+	NewSubConn(addr string, metadata interface{}) (SubConn, error)
+	RemoveSubConn(SubConn)
+	UpdatePicker(Picker)
+}
+
+// Balancer reacts to resolver and SubConn state changes by building new
+// Pickers and pushing them to its ClientConn.
+type Balancer interface {
+	UpdateSubConnState(SubConn, SubConnState)
+	Close()
+}
+
+// Builder creates a Balancer bound to a ClientConn.
+type Builder interface {
+	Build(cc ClientConn) Balancer
+	Name() string
+}
+
+var (
+	mu       sync.RWMutex
+	builders = make(map[string]Builder)
+)
+
+// Register registers b under its Name(), overwriting any previous
+// registration for that name.
+func Register(b Builder) {
+	mu.Lock()
+	defer mu.Unlock()
+	builders[b.Name()] = b
+}
+
+// Get looks up the Builder registered under name, ok is false if none is.
+func Get(name string) (b Builder, ok bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	b, ok = builders[name]
+	return
+}
+
+func init() {
+	Register(pickFirstBuilder{})
+	Register(roundRobinBuilder{})
+	Register(weightedLeastPendingBuilder{})
+}
+
+// --- pick_first ---
+
+type pickFirstBuilder struct{}
+
+func (pickFirstBuilder) Name() string { return "pick_first" }
+
+func (pickFirstBuilder) Build(cc ClientConn) Balancer {
+	return &pickFirstBalancer{cc: cc}
+}
+
+type pickFirstBalancer struct {
+	mu    sync.Mutex
+	cc    ClientConn
+	ready SubConn
+}
+
+func (b *pickFirstBalancer) UpdateSubConnState(sc SubConn, s SubConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s.Ready {
+		b.ready = sc
+	} else if b.ready == sc {
+		b.ready = nil
+	}
+	b.cc.UpdatePicker(&pickFirstPicker{sc: b.ready})
+}
+
+func (b *pickFirstBalancer) Close() {}
+
+type pickFirstPicker struct{ sc SubConn }
+
+func (p *pickFirstPicker) Pick(PickInfo) (PickResult, error) {
+	if p.sc == nil {
+		return PickResult{}, ErrNoSubConnAvailable
+	}
+	return PickResult{SubConn: p.sc}, nil
+}
+
+// --- round_robin ---
+
+type roundRobinBuilder struct{}
+
+func (roundRobinBuilder) Name() string { return "round_robin" }
+
+func (roundRobinBuilder) Build(cc ClientConn) Balancer {
+	return &roundRobinBalancer{cc: cc, subconns: make(map[SubConn]bool)}
+}
+
+type roundRobinBalancer struct {
+	mu       sync.Mutex
+	cc       ClientConn
+	subconns map[SubConn]bool // sc -> ready
+}
+
+func (b *roundRobinBalancer) UpdateSubConnState(sc SubConn, s SubConnState) {
+	b.mu.Lock()
+	b.subconns[sc] = s.Ready
+	ready := make([]SubConn, 0, len(b.subconns))
+	for sc, ok := range b.subconns {
+		if ok {
+			ready = append(ready, sc)
+		}
+	}
+	b.mu.Unlock()
+
+	b.cc.UpdatePicker(&roundRobinPicker{ready: ready})
+}
+
+func (b *roundRobinBalancer) Close() {}
+
+type roundRobinPicker struct {
+	ready []SubConn
+	next  uint32
+}
+
+func (p *roundRobinPicker) Pick(PickInfo) (PickResult, error) {
+	if len(p.ready) == 0 {
+		return PickResult{}, ErrNoSubConnAvailable
+	}
+	i := atomic.AddUint32(&p.next, 1)
+	return PickResult{SubConn: p.ready[int(i)%len(p.ready)]}, nil
+}
+
+// --- weighted_least_pending ---
+
+type weightedLeastPendingBuilder struct{}
+
+func (weightedLeastPendingBuilder) Name() string { return "weighted_least_pending" }
+
+func (weightedLeastPendingBuilder) Build(cc ClientConn) Balancer {
+	return &leastPendingBalancer{cc: cc, entries: make(map[SubConn]*pendingEntry)}
+}
+
+// pendingEntry is one SubConn's in-flight count and weight, as tracked by
+// leastPendingBalancer and read by leastPendingPicker.
+type pendingEntry struct {
+	count  *int64
+	weight int
+}
+
+// leastPendingBalancer tracks in-flight requests per SubConn and always
+// picks the one with the lowest count-to-weight ratio, so a slow subconn
+// naturally receives less new traffic without needing active health
+// probing, and a subconn with a larger resolver-assigned Weight absorbs a
+// proportionally larger share.
+type leastPendingBalancer struct {
+	mu      sync.Mutex
+	cc      ClientConn
+	entries map[SubConn]*pendingEntry
+}
+
+func (b *leastPendingBalancer) UpdateSubConnState(sc SubConn, s SubConnState) {
+	weight := s.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	b.mu.Lock()
+	if s.Ready {
+		e, ok := b.entries[sc]
+		if !ok {
+			var n int64
+			e = &pendingEntry{count: &n}
+			b.entries[sc] = e
+		}
+		e.weight = weight
+	} else {
+		delete(b.entries, sc)
+	}
+
+	picker := &leastPendingPicker{entries: make(map[SubConn]*pendingEntry, len(b.entries))}
+	for sc, e := range b.entries {
+		picker.entries[sc] = e
+	}
+	b.mu.Unlock()
+
+	b.cc.UpdatePicker(picker)
+}
+
+func (b *leastPendingBalancer) Close() {}
+
+type leastPendingPicker struct {
+	entries map[SubConn]*pendingEntry
+}
+
+func (p *leastPendingPicker) Pick(PickInfo) (PickResult, error) {
+	var (
+		best     SubConn
+		bestLoad float64 = -1
+	)
+	for sc, e := range p.entries {
+		load := float64(atomic.LoadInt64(e.count)) / float64(e.weight)
+		if bestLoad == -1 || load < bestLoad {
+			best, bestLoad = sc, load
+		}
+	}
+	if best == nil {
+		return PickResult{}, ErrNoSubConnAvailable
+	}
+
+	counter := p.entries[best].count
+	atomic.AddInt64(counter, 1)
+	return PickResult{
+		SubConn: best,
+		Done:    func(DoneInfo) { atomic.AddInt64(counter, -1) },
+	}, nil
+}
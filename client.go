@@ -0,0 +1,542 @@
+package qrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liexusong/qrpc/balancer"
+	"github.com/liexusong/qrpc/credentials"
+	"github.com/liexusong/qrpc/resolver"
+	"github.com/liexusong/qrpc/stats"
+)
+
+// ErrNoAddresses when a ClientConn's resolver hasn't produced any address yet
+var ErrNoAddresses = errors.New("qrpc: no addresses available")
+
+// ErrStreamReset when the peer reset the stream a call was waiting on
+var ErrStreamReset = errors.New("qrpc: stream reset by peer")
+
+// DialOption configures a ClientConn; see WithBalancerName.
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	balancerName string
+	stats        stats.Handlers
+	creds        credentials.TransportCredentials
+}
+
+// WithBalancerName selects the balancer.Builder (by Name()) a ClientConn
+// uses to pick among its subconns. Defaults to "pick_first".
+func WithBalancerName(name string) DialOption {
+	return func(o *dialOptions) { o.balancerName = name }
+}
+
+// WithStatsHandler registers a stats.Handler to observe connection and RPC
+// lifecycle events for every subconn of the resulting ClientConn. Passing
+// it more than once fans events out to every registered Handler, in
+// registration order.
+func WithStatsHandler(h stats.Handler) DialOption {
+	return func(o *dialOptions) { o.stats = append(o.stats, h) }
+}
+
+// WithTransportCredentials secures every subconn's connection with creds,
+// e.g. credentials.NewTLS. Without this option subconns dial plaintext
+// TCP, same as before credentials existed.
+func WithTransportCredentials(creds credentials.TransportCredentials) DialOption {
+	return func(o *dialOptions) { o.creds = creds }
+}
+
+// ClientConn owns a set of subconns driven by a resolver.Resolver and
+// picked by a balancer.Balancer, replacing what used to be a single
+// hand-managed connection per target. Use Dial to create one.
+type ClientConn struct {
+	target resolver.Target
+	res    resolver.Resolver
+	bal    balancer.Balancer
+	stats  stats.Handlers
+	creds  credentials.TransportCredentials
+
+	mu       sync.Mutex
+	subConns map[string]*subConn
+	picker   balancer.Picker
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// Dial parses target (e.g. "dns:///svc.local:8080" or
+// "static:///a:1,b:2"), starts its resolver and balancer, and returns a
+// ClientConn that keeps its subconns up to date as the resolver reports
+// changes.
+func Dial(target string, opts ...DialOption) (*ClientConn, error) {
+	o := dialOptions{balancerName: "pick_first"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	t := resolver.ParseTarget(target)
+	rb, err := resolver.Get(t.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	bb, ok := balancer.Get(o.balancerName)
+	if !ok {
+		return nil, errors.New("qrpc: unknown balancer " + o.balancerName)
+	}
+
+	cc := &ClientConn{
+		target:   t,
+		stats:    o.stats,
+		creds:    o.creds,
+		subConns: make(map[string]*subConn),
+		closeCh:  make(chan struct{}),
+	}
+	cc.bal = bb.Build(cc)
+
+	res, err := rb.Build(t, cc, resolver.BuildOptions{})
+	if err != nil {
+		cc.bal.Close()
+		return nil, err
+	}
+	cc.res = res
+
+	return cc, nil
+}
+
+// UpdateState implements resolver.ClientConn: it reconciles the resolved
+// address set against existing subconns, creating new ones and retiring
+// ones no longer reported.
+func (cc *ClientConn) UpdateState(s resolver.State) {
+	want := make(map[string]bool, len(s.Addresses))
+	for _, a := range s.Addresses {
+		want[a.Addr] = true
+		cc.mu.Lock()
+		_, exists := cc.subConns[a.Addr]
+		cc.mu.Unlock()
+		if !exists {
+			if _, err := cc.NewSubConn(a.Addr, a.Metadata); err != nil {
+				LogError("qrpc: NewSubConn failed", "addr", a.Addr, "err", err)
+			}
+		}
+	}
+
+	cc.mu.Lock()
+	var stale []*subConn
+	for addr, sc := range cc.subConns {
+		if !want[addr] {
+			stale = append(stale, sc)
+		}
+	}
+	cc.mu.Unlock()
+
+	for _, sc := range stale {
+		cc.RemoveSubConn(sc)
+	}
+}
+
+// ReportError implements resolver.ClientConn.
+func (cc *ClientConn) ReportError(err error) {
+	LogError("qrpc: resolver error", "target", cc.target, "err", err)
+}
+
+// NewSubConn implements balancer.ClientConn. metadata is the
+// resolver.Address.Metadata the resolver reported for addr, passed
+// through opaquely for the subConn to interpret (see weightFromMetadata).
+func (cc *ClientConn) NewSubConn(addr string, metadata interface{}) (balancer.SubConn, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if sc, ok := cc.subConns[addr]; ok {
+		return sc, nil
+	}
+
+	sc := &subConn{addr: addr, cc: cc, backoff: newBackoff(), weight: weightFromMetadata(metadata)}
+	cc.subConns[addr] = sc
+	sc.Connect()
+	return sc, nil
+}
+
+// weightFromMetadata extracts the int weight a resolver.Builder may have
+// attached to an Address as Metadata (see resolver.Address's doc
+// comment), defaulting to 1 for resolvers that don't set one.
+func weightFromMetadata(metadata interface{}) int {
+	if w, ok := metadata.(int); ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// RemoveSubConn implements balancer.ClientConn.
+func (cc *ClientConn) RemoveSubConn(s balancer.SubConn) {
+	sc, ok := s.(*subConn)
+	if !ok {
+		return
+	}
+
+	cc.mu.Lock()
+	delete(cc.subConns, sc.addr)
+	cc.mu.Unlock()
+
+	sc.close()
+}
+
+// UpdatePicker implements balancer.ClientConn.
+func (cc *ClientConn) UpdatePicker(p balancer.Picker) {
+	cc.mu.Lock()
+	cc.picker = p
+	cc.mu.Unlock()
+}
+
+// Call picks a subconn via the current Picker and issues a single
+// request/response round trip for cmd, returning the peer's reply frame.
+func (cc *ClientConn) Call(ctx context.Context, cmd Cmd, requestID uint64, payload []byte, header map[string]string) (*Frame, error) {
+	cc.mu.Lock()
+	picker := cc.picker
+	cc.mu.Unlock()
+
+	if picker == nil {
+		return nil, ErrNoAddresses
+	}
+
+	res, err := picker.Pick(balancer.PickInfo{Cmd: balancer.Cmd(cmd), RequestID: requestID, Header: header})
+	if err != nil {
+		return nil, err
+	}
+	sc := res.SubConn.(*subConn)
+
+	f, err := sc.call(ctx, cmd, requestID, payload, header)
+	if res.Done != nil {
+		res.Done(balancer.DoneInfo{Err: err})
+	}
+	return f, err
+}
+
+// Close tears down the resolver, balancer and every subconn.
+func (cc *ClientConn) Close() {
+	cc.closeOnce.Do(func() {
+		close(cc.closeCh)
+		if cc.res != nil {
+			cc.res.Close()
+		}
+		cc.bal.Close()
+
+		cc.mu.Lock()
+		subs := cc.subConns
+		cc.subConns = nil
+		cc.mu.Unlock()
+
+		for _, sc := range subs {
+			sc.close()
+		}
+	})
+}
+
+// subConn owns one dialed connection to an address, reconnecting with
+// exponential backoff while it isn't Ready.
+type subConn struct {
+	addr   string
+	cc     *ClientConn
+	weight int // resolver-assigned traffic share, see weightFromMetadata
+
+	backoff *backoff
+
+	// cs applies WINDOW_UPDATE/SETTINGS frames the peer sends back on
+	// this connection (see call's read loop); subConn never multiplexes
+	// so it never needs cs.CreateOrGetStream/GetStream for anything but
+	// that bookkeeping. Reassigned under mu on every reconnect, same as
+	// conn/reader.
+	cs *ConnStreams
+
+	// writeMu serializes call's encode-then-write sequence: headerTable
+	// is a dynamic table that EncodeHeaderBlock grows as outgoing headers
+	// reference earlier ones, and writeFrame's header/payload writes must
+	// land on the wire in the same order they were encoded in, or the
+	// peer's decoder desyncs from ours for the rest of the connection.
+	// call's doc comment says callers shouldn't overlap anyway; this
+	// makes that safe rather than merely advisory.
+	writeMu     sync.Mutex
+	headerTable *DynamicTable
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *defaultFrameReader
+	closed bool
+}
+
+// Connect implements balancer.SubConn: it (re)establishes the underlying
+// connection in the background if one isn't already up.
+func (sc *subConn) Connect() {
+	GoFunc(nil, sc.connectLoop)
+}
+
+func (sc *subConn) connectLoop() {
+	for {
+		sc.mu.Lock()
+		if sc.closed || sc.conn != nil {
+			sc.mu.Unlock()
+			return
+		}
+		sc.mu.Unlock()
+
+		conn, err := net.DialTimeout("tcp", sc.addr, 10*time.Second)
+		if err != nil {
+			sc.cc.bal.UpdateSubConnState(sc, balancer.SubConnState{Ready: false, Err: err})
+			sc.backoff.wait(sc.cc.closeCh)
+			continue
+		}
+
+		if creds := sc.cc.creds; creds != nil {
+			conn, _, err = creds.ClientHandshake(context.Background(), authority(sc.addr), conn)
+			if err != nil {
+				sc.cc.bal.UpdateSubConnState(sc, balancer.SubConnState{Ready: false, Err: err})
+				sc.backoff.wait(sc.cc.closeCh)
+				continue
+			}
+		}
+
+		sc.mu.Lock()
+		sc.conn = conn
+		sc.reader = newFrameReaderWithStats(context.Background(), conn, 0, 0, 0, sc.cc.stats, true)
+		sc.cs = &ConnStreams{}
+		sc.mu.Unlock()
+
+		sc.writeMu.Lock()
+		sc.headerTable = NewDynamicTable(0)
+		sc.writeMu.Unlock()
+
+		// Announce our initial window to the peer so its sends don't
+		// stall waiting for a SETTINGS it never gets; see newConn's
+		// symmetric send on the server side.
+		if err := writeFrame(conn, 0, CmdSettings, 0, EncodeWindowUpdate(uint32(DefaultInitialWindowSize))); err != nil {
+			LogError("subConn handshake write failed", "addr", sc.addr, "err", err)
+			conn.Close()
+			sc.mu.Lock()
+			sc.conn = nil
+			sc.reader = nil
+			sc.mu.Unlock()
+			sc.cc.bal.UpdateSubConnState(sc, balancer.SubConnState{Ready: false, Err: err})
+			sc.backoff.wait(sc.cc.closeCh)
+			continue
+		}
+
+		if sh := sc.cc.stats; sh != nil {
+			ctx := sh.TagConn(context.Background(), &stats.ConnTagInfo{
+				RemoteAddr: conn.RemoteAddr().String(),
+				LocalAddr:  conn.LocalAddr().String(),
+			})
+			cb := stats.ConnBegin{}
+			cb.Client = true
+			sh.HandleConn(ctx, cb)
+		}
+
+		sc.backoff.reset()
+		sc.cc.bal.UpdateSubConnState(sc, balancer.SubConnState{Ready: true, Weight: sc.weight})
+		return
+	}
+}
+
+func (sc *subConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	conn := sc.conn
+	sc.conn = nil
+	sc.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+		if sh := sc.cc.stats; sh != nil {
+			ce := stats.ConnEnd{}
+			ce.Client = true
+			sh.HandleConn(context.Background(), ce)
+		}
+	}
+}
+
+// authority extracts the host part of addr for use as the server name a
+// TransportCredentials verifies during ClientHandshake, falling back to
+// addr itself if it isn't a host:port pair.
+func authority(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// call writes one request frame and blocks for the matching reply. It
+// does not multiplex: qrpc.ClientConn callers are expected to issue one
+// Call at a time per subconn, same as a bare net.Conn round trip.
+func (sc *subConn) call(ctx context.Context, cmd Cmd, requestID uint64, payload []byte, header map[string]string) (*Frame, error) {
+	sc.mu.Lock()
+	conn, reader, cs := sc.conn, sc.reader, sc.cs
+	sc.mu.Unlock()
+
+	if conn == nil {
+		return nil, ErrNoAddresses
+	}
+
+	sh := sc.cc.stats
+	begin := time.Now()
+	if sh != nil {
+		ctx = sh.TagRPC(ctx, &stats.RPCTagInfo{Cmd: uint32(cmd), RequestID: requestID})
+		b := stats.Begin{Cmd: uint32(cmd), RequestID: requestID, BeginTime: begin}
+		b.Client = true
+		sh.HandleRPC(ctx, b)
+	}
+
+	flags := FrameFlag(0)
+	wireLen := 16 + len(payload)
+	var fields []HeaderField
+	if len(header) > 0 {
+		fields = make([]HeaderField, 0, len(header))
+		for name, value := range header {
+			fields = append(fields, HeaderField{Name: name, Value: value})
+		}
+		flags |= FlagHeader
+	}
+
+	// writeMu keeps the header encode (which grows headerTable) and the
+	// write it produced in the same order on the wire as every other
+	// call on this subconn; see writeMu's doc comment.
+	sc.writeMu.Lock()
+	outPayload := payload
+	if fields != nil {
+		outPayload = prependHeaderBlock(EncodeHeaderBlock(sc.headerTable, fields), payload)
+		wireLen = 16 + len(outPayload)
+	}
+	err := writeFrame(conn, requestID, cmd, flags, outPayload)
+	sc.writeMu.Unlock()
+
+	var f *Frame
+	if err == nil {
+		if sh != nil {
+			op := stats.OutPayload{RequestID: requestID, Length: len(payload), WireLength: wireLen, SentTime: time.Now()}
+			op.Client = true
+			sh.HandleRPC(ctx, op)
+		}
+		f, err = sc.readReply(reader, cs, requestID)
+	}
+
+	if sh != nil {
+		e := stats.End{RequestID: requestID, Error: err, Duration: time.Since(begin)}
+		e.Client = true
+		sh.HandleRPC(ctx, e)
+	}
+
+	return f, err
+}
+
+// readReply reads frames off reader until it finds the one replying to
+// requestID, applying (rather than returning) any control frame it sees
+// along the way. Mirrors defaultFrameReader.ReadFrame's handling of
+// IsRst/CmdWindowUpdate/CmdSettings, minus the stream-binding logic that
+// only matters for the server's multiplexed reads: call never has more
+// than one request in flight per subconn, so there is nothing to bind.
+func (sc *subConn) readReply(reader *defaultFrameReader, cs *ConnStreams, requestID uint64) (*Frame, error) {
+	for {
+		f, err := reader.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if f.Flags.IsRst() {
+			if f.RequestID == requestID {
+				return nil, ErrStreamReset
+			}
+			continue
+		}
+		if f.Cmd == CmdWindowUpdate {
+			delta, err := DecodeWindowUpdate(f.Payload)
+			if err != nil {
+				LogError("bad WINDOW_UPDATE", "requestID", f.RequestID, "err", err)
+				continue
+			}
+			cs.ApplyWindowUpdate(f.RequestID, delta)
+			continue
+		}
+		if f.Cmd == CmdSettings {
+			delta, err := DecodeWindowUpdate(f.Payload)
+			if err != nil {
+				LogError("bad SETTINGS", "requestID", f.RequestID, "err", err)
+				continue
+			}
+			cs.ApplyInitialWindow(delta)
+			continue
+		}
+
+		if f.RequestID != requestID {
+			continue
+		}
+		return f, nil
+	}
+}
+
+// writeFrame encodes a frame using the same 12-byte-header wire format
+// defaultFrameReader.readFrame expects: size, requestID, cmd|flags.
+func writeFrame(w net.Conn, requestID uint64, cmd Cmd, flags FrameFlag, payload []byte) error {
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint32(header, uint32(12+len(payload)))
+	binary.BigEndian.PutUint64(header[4:], requestID)
+	binary.BigEndian.PutUint32(header[12:], uint32(cmd)|uint32(flags)<<24)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// backoff implements the reconnect schedule: base 1s, factor 1.6, up to
+// 20% jitter, capped at 120s.
+type backoff struct {
+	mu      sync.Mutex
+	attempt int
+}
+
+func newBackoff() *backoff { return &backoff{} }
+
+const (
+	backoffBase   = time.Second
+	backoffFactor = 1.6
+	backoffJitter = 0.2
+	backoffCap    = 120 * time.Second
+)
+
+func (b *backoff) reset() {
+	b.mu.Lock()
+	b.attempt = 0
+	b.mu.Unlock()
+}
+
+// wait sleeps for this attempt's backoff duration, or returns early if
+// done is closed.
+func (b *backoff) wait(done <-chan struct{}) {
+	b.mu.Lock()
+	attempt := b.attempt
+	b.attempt++
+	b.mu.Unlock()
+
+	d := float64(backoffBase) * pow(backoffFactor, attempt)
+	if d > float64(backoffCap) {
+		d = float64(backoffCap)
+	}
+	d += d * backoffJitter * (rand.Float64()*2 - 1)
+
+	select {
+	case <-time.After(time.Duration(d)):
+	case <-done:
+	}
+}
+
+func pow(base float64, exp int) float64 {
+	result := 1.0
+	for i := 0; i < exp; i++ {
+		result *= base
+	}
+	return result
+}
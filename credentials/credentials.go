@@ -0,0 +1,187 @@
+// Package credentials defines the TransportCredentials interface used to
+// secure the raw net.Conn a qrpc server accepts or a qrpc client dials,
+// modeled on grpc-go's credentials package. qrpc itself never imports
+// crypto/tls directly; NewTLS/NewMTLS are the built-in implementations,
+// and callers are free to supply their own (mTLS variants, a custom VPN
+// transport, etc.) by implementing TransportCredentials.
+package credentials
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// DefaultALPNProto is negotiated via ALPN by NewTLS/NewMTLS so a TLS
+// listener can tell a qrpc connection apart from e.g. HTTP/1.1 or h2
+// sharing the same port.
+const DefaultALPNProto = "qrpc/1"
+
+// AuthInfo is implemented by the per-connection identity TransportCredentials
+// produces during its handshake, e.g. TLSInfo. It is stashed in the
+// ConnectionInfo a Handler sees, so ServeMux handlers can authorize based
+// on verified identity instead of just the remote address.
+type AuthInfo interface {
+	AuthType() string
+}
+
+// ProtocolInfo describes the security protocol in use; returned by
+// TransportCredentials.Info for logging/diagnostics.
+type ProtocolInfo struct {
+	// SecurityProtocol is the name of the underlying security protocol,
+	// e.g. "tls".
+	SecurityProtocol string
+	// SecurityVersion is the version of the security protocol.
+	SecurityVersion string
+}
+
+// TransportCredentials wraps the raw net.Conn a qrpc server accepts or a
+// qrpc client dials with a handshake that authenticates and/or encrypts
+// it. ServerBinding.Creds and client DialOptions accept one.
+type TransportCredentials interface {
+	// ClientHandshake does the authentication handshake for a connection
+	// dialed by a qrpc client, returning the secured conn and the
+	// identity of the server it authenticated, or an error if the
+	// handshake fails. authority is the server name to verify against,
+	// e.g. the host part of the dial target.
+	ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, AuthInfo, error)
+
+	// ServerHandshake does the authentication handshake for a connection
+	// accepted by a qrpc server, returning the secured conn and the
+	// identity of the client it authenticated, or an error if the
+	// handshake fails.
+	ServerHandshake(conn net.Conn) (net.Conn, AuthInfo, error)
+
+	// Info returns metadata about the security protocol for logging.
+	Info() ProtocolInfo
+
+	// Clone makes a deep copy of the TransportCredentials.
+	Clone() TransportCredentials
+}
+
+// TLSInfo is the AuthInfo produced by the tls TransportCredentials built
+// by NewTLS/NewMTLS.
+type TLSInfo struct {
+	State tls.ConnectionState
+}
+
+// AuthType implements AuthInfo.
+func (TLSInfo) AuthType() string { return "tls" }
+
+// PeerCertificates returns the verified certificate chain presented by
+// the peer, or nil if none was presented/required.
+func (t TLSInfo) PeerCertificates() []*x509.Certificate {
+	return t.State.PeerCertificates
+}
+
+type tlsCreds struct {
+	config *tls.Config
+}
+
+func withALPN(c *tls.Config) *tls.Config {
+	cfg := c.Clone()
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{DefaultALPNProto}
+	}
+	return cfg
+}
+
+// NewTLS builds a TransportCredentials out of a *tls.Config, defaulting
+// NextProtos to DefaultALPNProto if the caller hasn't set one so qrpc can
+// be multiplexed with other ALPN-aware protocols on the same port.
+func NewTLS(config *tls.Config) TransportCredentials {
+	return &tlsCreds{config: withALPN(config)}
+}
+
+// NewMTLS builds mutual-TLS TransportCredentials: certFile/keyFile are
+// this side's own certificate, used for both ServerHandshake and
+// ClientHandshake, and caFile is the PEM bundle of CA certificates used
+// to verify the peer's certificate. Both sides must present a
+// certificate signed by a CA in caFile.
+func NewMTLS(certFile, keyFile, caFile string) (TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("credentials: failed to parse CA certificate")
+	}
+
+	return NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		RootCAs:      pool,
+	}), nil
+}
+
+// ClientHandshake implements TransportCredentials.
+func (c *tlsCreds) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, AuthInfo, error) {
+	cfg := c.config
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = authority
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := handshake(ctx, tlsConn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return tlsConn, TLSInfo{State: tlsConn.ConnectionState()}, nil
+}
+
+// ServerHandshake implements TransportCredentials.
+func (c *tlsCreds) ServerHandshake(conn net.Conn) (net.Conn, AuthInfo, error) {
+	tlsConn := tls.Server(conn, c.config)
+	if err := handshake(context.Background(), tlsConn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return tlsConn, TLSInfo{State: tlsConn.ConnectionState()}, nil
+}
+
+// Info implements TransportCredentials.
+func (c *tlsCreds) Info() ProtocolInfo {
+	return ProtocolInfo{SecurityProtocol: "tls", SecurityVersion: tlsVersionName(c.config.MinVersion)}
+}
+
+// Clone implements TransportCredentials.
+func (c *tlsCreds) Clone() TransportCredentials {
+	return &tlsCreds{config: c.config.Clone()}
+}
+
+// handshake runs conn.HandshakeContext, respecting ctx's deadline/cancel
+// when the caller supplied one.
+func handshake(ctx context.Context, conn *tls.Conn) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return conn.HandshakeContext(ctx)
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return "unspecified"
+	}
+}
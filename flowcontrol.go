@@ -0,0 +1,360 @@
+package qrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Cmd is a 24bit value (see defaultFrameReader.readFrame), so the reserved
+// flow-control commands are picked from the very top of that range to make
+// collisions with user-registered Cmds vanishingly unlikely.
+const (
+	// CmdWindowUpdate carries a flow-control window increment for either a
+	// single stream (RequestID set) or the whole connection (RequestID 0).
+	// It is consumed by defaultFrameReader.readFrame and never reaches a
+	// Handler.
+	CmdWindowUpdate Cmd = 0xffffff - iota
+	// CmdSettings is exchanged right after the connection is accepted/
+	// dialed so both peers agree on the initial send windows before any
+	// data frame is written.
+	CmdSettings
+)
+
+// ErrWindowOverflow when a WINDOW_UPDATE increment would overflow the window
+var ErrWindowOverflow = errors.New("flow control window overflow")
+
+// DefaultInitialWindowSize is the per-stream and per-connection send window
+// used when ServerBinding.InitialWindowSize/InitialConnWindowSize is 0.
+const DefaultInitialWindowSize = 64 * 1024
+
+// flowWindow is a send window shared by writers blocked on WriteBytes/
+// EndWrite and replenished by WINDOW_UPDATE frames from the peer. One is
+// kept per stream and one per connection; a write must acquire from both
+// before it is allowed onto the wire.
+type flowWindow struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	available int64
+	closed    bool
+}
+
+func newFlowWindow(initial uint32) *flowWindow {
+	fw := &flowWindow{available: int64(initial)}
+	fw.cond = sync.NewCond(&fw.mu)
+	return fw
+}
+
+// Take blocks until n bytes are available and deducts them from the
+// window. It returns false without blocking further if the window is
+// closed, e.g. because the stream reset or the connection went away.
+func (fw *flowWindow) Take(n int) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	for fw.available <= 0 && !fw.closed {
+		fw.cond.Wait()
+	}
+	if fw.closed {
+		return false
+	}
+
+	fw.available -= int64(n)
+	return true
+}
+
+// TryTake deducts n bytes from the window without blocking, reporting
+// whether it had the room. Used by the write scheduler, which must be
+// able to skip a stream whose window is empty instead of stalling every
+// other stream behind it.
+func (fw *flowWindow) TryTake(n int) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.closed || fw.available < int64(n) {
+		return false
+	}
+
+	fw.available -= int64(n)
+	return true
+}
+
+// Increase enlarges the window by delta and wakes any writer blocked in
+// Take. Called when a WINDOW_UPDATE frame arrives from the peer.
+func (fw *flowWindow) Increase(delta uint32) {
+	fw.mu.Lock()
+	fw.available += int64(delta)
+	fw.mu.Unlock()
+	fw.cond.Broadcast()
+}
+
+// Close unblocks any writer waiting in Take for good, e.g. on stream reset
+// or connection teardown.
+func (fw *flowWindow) Close() {
+	fw.mu.Lock()
+	fw.closed = true
+	fw.mu.Unlock()
+	fw.cond.Broadcast()
+}
+
+// recvWindow tracks bytes consumed on the receive side of a stream and
+// decides when enough has been consumed to justify sending a WINDOW_UPDATE
+// back to the peer, so the peer's send window gets refilled before it runs
+// dry.
+type recvWindow struct {
+	mu        sync.Mutex
+	consumed  uint32
+	threshold uint32
+}
+
+func newRecvWindow(initial uint32) *recvWindow {
+	return &recvWindow{threshold: initial / 2}
+}
+
+// Consume accounts for n newly processed bytes and returns the increment
+// to send back to the peer, or 0 if the threshold hasn't been crossed yet.
+func (rw *recvWindow) Consume(n int) uint32 {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	rw.consumed += uint32(n)
+	if rw.consumed < rw.threshold {
+		return 0
+	}
+
+	delta := rw.consumed
+	rw.consumed = 0
+	return delta
+}
+
+// EncodeWindowUpdate builds the payload of a WINDOW_UPDATE frame: a single
+// big-endian uint32 increment.
+func EncodeWindowUpdate(delta uint32) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, delta)
+	return payload
+}
+
+// DecodeWindowUpdate parses the payload of a WINDOW_UPDATE frame.
+func DecodeWindowUpdate(payload []byte) (delta uint32, err error) {
+	if len(payload) != 4 {
+		return 0, ErrInvalidFrameSize
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// Consume tells the stream that n bytes of this frame's payload have been
+// processed by the handler. Once enough bytes have been consumed to cross
+// the refill threshold, a WINDOW_UPDATE is queued back to the peer for
+// both the stream and the connection.
+func (f *Frame) Consume(n int) {
+	if f.stream == nil {
+		return
+	}
+	addFrameConsumed(f, n)
+	f.stream.consumeWindow(n)
+}
+
+// frameConsumed tracks, per Frame, how many payload bytes Consume has
+// already accounted for, so AutoConsume can tell how much of the payload
+// a Handler left unconsumed instead of double-counting.
+var frameConsumed sync.Map // map[*Frame]*int64
+
+func addFrameConsumed(f *Frame, n int) int64 {
+	v, _ := frameConsumed.LoadOrStore(f, new(int64))
+	return atomic.AddInt64(v.(*int64), int64(n))
+}
+
+// AutoConsume consumes whatever part of f's payload a Handler never
+// passed to Consume itself. A Handler that ignores flow control
+// entirely would otherwise exhaust its peer's send window after the
+// first DefaultInitialWindowSize bytes and stall the stream for good;
+// this is the fallback the request body describes as "or when the frame
+// is fully processed", called once a Handler returns (see
+// ServeMux.ServeQRPC) regardless of whether it called Consume itself.
+func (f *Frame) AutoConsume() {
+	defer frameConsumed.Delete(f)
+	defer frameHeaders.Delete(f)
+
+	if f.stream == nil {
+		return
+	}
+
+	v, _ := frameConsumed.LoadOrStore(f, new(int64))
+	done := atomic.LoadInt64(v.(*int64))
+	remaining := int64(len(f.Payload)) - done
+	if remaining > 0 {
+		f.stream.consumeWindow(int(remaining))
+	}
+}
+
+// ApplyWindowUpdate applies a WINDOW_UPDATE received from the peer: a
+// requestID of 0 refills the connection-wide send window, otherwise it
+// refills the named stream's send window.
+func (cs *ConnStreams) ApplyWindowUpdate(requestID uint64, delta uint32) {
+	if requestID == 0 {
+		cs.connSendWindow().Increase(delta)
+		return
+	}
+
+	s := cs.GetStream(requestID, 0)
+	if s == nil {
+		return
+	}
+	trackStream(cs, s)
+	s.sendWindow().Increase(delta)
+}
+
+// ApplyInitialWindow handles the CmdSettings handshake frame exchanged at
+// connection open, seeding the connection-wide send window to the value
+// the peer announced.
+func (cs *ConnStreams) ApplyInitialWindow(initial uint32) {
+	cs.connSendWindow().Increase(initial)
+}
+
+// connWindows and streamWindows hold the flow-control windows keyed by the
+// owning ConnStreams/Stream. They live outside those structs so this
+// feature doesn't need to touch every place a ConnStreams/Stream is
+// constructed; a window is created lazily with DefaultInitialWindowSize on
+// first use.
+var (
+	connWindows   sync.Map // map[*ConnStreams]*flowWindow
+	streamWindows sync.Map // map[*Stream]*flowWindow
+)
+
+// connStreamSets remembers every *Stream a ConnStreams' flow-control (or
+// scheduler, see scheduler.go) side-tables have an entry for, purely so
+// Cleanup can release all of them in one pass once the connection tears
+// down — none of connWindows/streamWindows/streamRecvWindows/
+// streamPriorities/streamMetricsTable would otherwise ever shed an entry
+// for the life of the process.
+var connStreamSets sync.Map // map[*ConnStreams]*sync.Map (set of *Stream)
+
+// trackStream records that s belongs to cs, for Cleanup to find later.
+// Called from every place in this package that first creates a
+// stream-keyed side-table entry.
+func trackStream(cs *ConnStreams, s *Stream) {
+	v, _ := connStreamSets.LoadOrStore(cs, &sync.Map{})
+	v.(*sync.Map).Store(s, struct{}{})
+}
+
+// newClosedFlowWindow is a flowWindow that is already closed, for
+// closeStreamWindow/closeConnWindow to install via LoadOrStore: if no
+// window existed yet, this makes the eventual first sendWindow()/
+// connSendWindow() LoadOrStore find an already-closed one instead of
+// racing a concurrent AcquireSendWindow into lazily creating a fresh,
+// open one that would then never be closed.
+func newClosedFlowWindow() *flowWindow {
+	fw := newFlowWindow(0)
+	fw.closed = true
+	return fw
+}
+
+// closeStreamWindow closes s's send window, creating it pre-closed if one
+// was never created, so a writer already parked in flowWindow.Take (see
+// AcquireSendWindow) wakes up with ok=false instead of blocking forever,
+// and a writer that hasn't called AcquireSendWindow yet gets the same
+// pre-closed window rather than a fresh open one.
+func closeStreamWindow(s *Stream) {
+	v, loaded := streamWindows.LoadOrStore(s, newClosedFlowWindow())
+	if loaded {
+		v.(*flowWindow).Close()
+	}
+}
+
+// closeConnWindow is closeStreamWindow's connection-scoped counterpart.
+func closeConnWindow(cs *ConnStreams) {
+	v, loaded := connWindows.LoadOrStore(cs, newClosedFlowWindow())
+	if loaded {
+		v.(*flowWindow).Close()
+	}
+}
+
+// Cleanup releases every flow-control (and, transitively, scheduler)
+// side-table entry kept for cs and the streams multiplexed on it,
+// closing every flowWindow along the way so a writer still parked in
+// Take wakes up instead of leaking. Call once the owning connection has
+// fully torn down, e.g. from Server.untrack.
+func (cs *ConnStreams) Cleanup() {
+	closeConnWindow(cs)
+	connWindows.Delete(cs)
+
+	v, ok := connStreamSets.LoadAndDelete(cs)
+	if !ok {
+		return
+	}
+	v.(*sync.Map).Range(func(k, _ interface{}) bool {
+		s := k.(*Stream)
+		closeStreamWindow(s)
+		streamWindows.Delete(s)
+		streamRecvWindows.Delete(s)
+		streamPriorities.Delete(s)
+		streamMetricsTable.Delete(s)
+		streamStats.Delete(s)
+		return true
+	})
+}
+
+func (cs *ConnStreams) connSendWindow() *flowWindow {
+	v, _ := connWindows.LoadOrStore(cs, newFlowWindow(DefaultInitialWindowSize))
+	return v.(*flowWindow)
+}
+
+func (s *Stream) sendWindow() *flowWindow {
+	v, _ := streamWindows.LoadOrStore(s, newFlowWindow(DefaultInitialWindowSize))
+	return v.(*flowWindow)
+}
+
+// consumeWindow accounts for n bytes processed off this stream and, once
+// the refill threshold is crossed, emits WINDOW_UPDATE frames back to the
+// peer for both the stream and the connection.
+func (s *Stream) consumeWindow(n int) {
+	v, _ := streamRecvWindows.LoadOrStore(s, newRecvWindow(DefaultInitialWindowSize))
+	rw := v.(*recvWindow)
+
+	if delta := rw.Consume(n); delta > 0 {
+		w := s.GetWriter()
+		if w != nil {
+			w.StartWrite(s.RequestID(), CmdWindowUpdate, 0)
+			w.WriteBytes(EncodeWindowUpdate(delta))
+			w.EndWrite()
+		}
+	}
+}
+
+var streamRecvWindows sync.Map // map[*Stream]*recvWindow
+
+// AcquireSendWindow blocks a writer until both the stream's and the
+// connection's send window have room for n bytes, deducting from both.
+// A FrameWriter implementation should call this before putting a data
+// frame's payload on the wire, and treat a false return the same as a
+// closed connection/reset stream.
+func AcquireSendWindow(cs *ConnStreams, s *Stream, n int) bool {
+	trackStream(cs, s)
+	if !cs.connSendWindow().Take(n) {
+		return false
+	}
+	if !s.sendWindow().Take(n) {
+		cs.connSendWindow().Increase(uint32(n))
+		return false
+	}
+	return true
+}
+
+// TryAcquireSendWindow is the non-blocking counterpart of
+// AcquireSendWindow: it reports whether both windows currently have room
+// for n bytes, deducting from both only if they both do. Used by the
+// write scheduler to skip a stream that isn't ready instead of blocking
+// the whole connection behind it.
+func TryAcquireSendWindow(cs *ConnStreams, s *Stream, n int) bool {
+	trackStream(cs, s)
+	if !cs.connSendWindow().TryTake(n) {
+		return false
+	}
+	if !s.sendWindow().TryTake(n) {
+		cs.connSendWindow().Increase(uint32(n))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package qrpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowWindowTakeBlocksUntilIncrease(t *testing.T) {
+	fw := newFlowWindow(0)
+
+	done := make(chan bool, 1)
+	go func() { done <- fw.Take(10) }()
+
+	select {
+	case <-done:
+		t.Fatal("Take returned before Increase gave it room")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	fw.Increase(10)
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Take = false after Increase, want true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Take never returned after Increase")
+	}
+}
+
+func TestFlowWindowTakeUnblocksOnClose(t *testing.T) {
+	fw := newFlowWindow(0)
+
+	done := make(chan bool, 1)
+	go func() { done <- fw.Take(10) }()
+
+	fw.Close()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Take = true after Close, want false")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Take never returned after Close")
+	}
+}
+
+func TestFlowWindowTryTake(t *testing.T) {
+	fw := newFlowWindow(10)
+
+	if !fw.TryTake(10) {
+		t.Fatal("TryTake(10) on a window of 10: want true")
+	}
+	if fw.TryTake(1) {
+		t.Fatal("TryTake(1) on an exhausted window: want false")
+	}
+
+	fw.Increase(5)
+	if !fw.TryTake(5) {
+		t.Fatal("TryTake(5) after Increase(5): want true")
+	}
+}
+
+func TestFlowWindowTryTakeAfterClose(t *testing.T) {
+	fw := newFlowWindow(10)
+	fw.Close()
+
+	if fw.TryTake(1) {
+		t.Error("TryTake on a closed window: want false")
+	}
+}
+
+func TestRecvWindowConsumeThreshold(t *testing.T) {
+	rw := newRecvWindow(100) // threshold = 50
+
+	if delta := rw.Consume(30); delta != 0 {
+		t.Errorf("Consume(30) = %d, want 0 (below threshold)", delta)
+	}
+	if delta := rw.Consume(25); delta != 55 {
+		t.Errorf("Consume(25) = %d, want 55 (crossed threshold)", delta)
+	}
+	// consumed resets to 0 once the threshold triggers a delta.
+	if delta := rw.Consume(10); delta != 0 {
+		t.Errorf("Consume(10) after reset = %d, want 0", delta)
+	}
+}
+
+func TestEncodeDecodeWindowUpdateRoundTrip(t *testing.T) {
+	for _, delta := range []uint32{0, 1, 1024, 1 << 31} {
+		payload := EncodeWindowUpdate(delta)
+		got, err := DecodeWindowUpdate(payload)
+		if err != nil {
+			t.Fatalf("DecodeWindowUpdate(%d): %v", delta, err)
+		}
+		if got != delta {
+			t.Errorf("DecodeWindowUpdate(EncodeWindowUpdate(%d)) = %d", delta, got)
+		}
+	}
+}
+
+func TestDecodeWindowUpdateInvalidSize(t *testing.T) {
+	if _, err := DecodeWindowUpdate([]byte{1, 2, 3}); err == nil {
+		t.Error("DecodeWindowUpdate on a 3-byte payload: expected error, got nil")
+	}
+}
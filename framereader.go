@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"time"
 	"unsafe"
+
+	"github.com/liexusong/qrpc/stats"
 )
 
 var (
@@ -22,6 +25,9 @@ type defaultFrameReader struct {
 	rbuf         [16]byte // for header
 	ctx          context.Context
 	maxFrameSize int
+	headerTable  *DynamicTable
+	stats        stats.Handlers
+	isClient     bool
 }
 
 // newFrameReader creates a FrameWriter instance to read frames
@@ -30,7 +36,25 @@ func newFrameReader(ctx context.Context, rwc net.Conn, timeout int) *defaultFram
 }
 
 func newFrameReaderWithMFS(ctx context.Context, rwc net.Conn, timeout int, maxFrameSize int) *defaultFrameReader {
-	return &defaultFrameReader{Reader: NewReaderWithTimeout(ctx, rwc, timeout), ctx: ctx, maxFrameSize: maxFrameSize}
+	return newFrameReaderWithHeaderTableSize(ctx, rwc, timeout, maxFrameSize, 0)
+}
+
+func newFrameReaderWithHeaderTableSize(ctx context.Context, rwc net.Conn, timeout int, maxFrameSize int, headerTableSize int) *defaultFrameReader {
+	return newFrameReaderWithStats(ctx, rwc, timeout, maxFrameSize, headerTableSize, nil, false)
+}
+
+// newFrameReaderWithStats is the fully configured constructor; the callers
+// above exist only to give server-side code short call sites that default
+// to no stats reporting.
+func newFrameReaderWithStats(ctx context.Context, rwc net.Conn, timeout int, maxFrameSize int, headerTableSize int, statsHandlers stats.Handlers, isClient bool) *defaultFrameReader {
+	return &defaultFrameReader{
+		Reader:       NewReaderWithTimeout(ctx, rwc, timeout),
+		ctx:          ctx,
+		maxFrameSize: maxFrameSize,
+		headerTable:  NewDynamicTable(headerTableSize),
+		stats:        statsHandlers,
+		isClient:     isClient,
+	}
 }
 
 // ReadFrame will only return the first frame in stream
@@ -54,13 +78,40 @@ start:
 			s := cs.GetStream(requestID, flags)
 			if s != nil {
 				s.ResetByPeer()
+				closeStreamWindow(s)
 			}
 
 			goto start
 		}
+
+		// handle flow control frames inline: they never reach a Handler
+		if f.Cmd == CmdWindowUpdate {
+			delta, err := DecodeWindowUpdate(f.Payload)
+			if err != nil {
+				LogError("bad WINDOW_UPDATE", "requestID", requestID, "err", err)
+				goto start
+			}
+			cs.ApplyWindowUpdate(requestID, delta)
+			goto start
+		}
+		if f.Cmd == CmdSettings {
+			delta, err := DecodeWindowUpdate(f.Payload)
+			if err != nil {
+				LogError("bad SETTINGS", "requestID", requestID, "err", err)
+				goto start
+			}
+			cs.ApplyInitialWindow(delta)
+			goto start
+		}
+
 		s, loaded := cs.CreateOrGetStream(dfr.ctx, requestID, flags)
 		if !loaded {
 			LogDebug(unsafe.Pointer(cs), "defaultFrameReader new stream:", requestID, flags, f.Cmd)
+			if dfr.stats != nil {
+				trackStream(cs, s)
+				rpcCtx := dfr.stats.TagRPC(dfr.ctx, &stats.RPCTagInfo{Cmd: uint32(f.Cmd), RequestID: requestID})
+				streamStats.Store(s, &rpcStatsContext{handlers: dfr.stats, ctx: rpcCtx})
+			}
 		}
 
 		if s.TryBind(f) {
@@ -105,5 +156,38 @@ func (dfr *defaultFrameReader) readFrame() (*Frame, error) {
 		return nil, err
 	}
 
-	return &Frame{RequestID: requestID, Cmd: cmd, Flags: flags, Payload: payload}, nil
+	var headers map[string]string
+	if flags.HasHeaders() {
+		headerBlock, rest, err := splitHeaderBlock(payload)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := DecodeHeaderBlock(dfr.headerTable, headerBlock)
+		if err != nil {
+			return nil, err
+		}
+		headers = make(map[string]string, len(fields))
+		for _, f := range fields {
+			headers[f.Name] = f.Value
+		}
+		payload = rest
+	}
+
+	f := &Frame{RequestID: requestID, Cmd: cmd, Flags: flags, Payload: payload}
+	if headers != nil {
+		frameHeaders.Store(f, headers)
+	}
+
+	if dfr.stats != nil {
+		if headers != nil {
+			ih := stats.InHeader{RequestID: requestID, Header: headers}
+			ih.Client = dfr.isClient
+			dfr.stats.HandleRPC(dfr.ctx, ih)
+		}
+		ip := stats.InPayload{RequestID: requestID, Length: len(payload), WireLength: int(size), RecvTime: time.Now()}
+		ip.Client = dfr.isClient
+		dfr.stats.HandleRPC(dfr.ctx, ip)
+	}
+
+	return f, nil
 }
@@ -0,0 +1,341 @@
+package qrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// ErrInvalidHeaderBlock when a header block fails to parse
+var ErrInvalidHeaderBlock = errors.New("invalid header block")
+
+// FlagHeader marks a frame whose Payload is prefixed by a compressed
+// header block, decoded by defaultFrameReader.readFrame before the rest
+// of the Payload is handed to the caller. Picked from an unused high bit
+// so it composes with IsRst and friends.
+const FlagHeader FrameFlag = 1 << 5
+
+// HasHeaders reports whether the frame carries a header block.
+func (f FrameFlag) HasHeaders() bool { return f&FlagHeader != 0 }
+
+// DefaultHeaderTableSize is the default size, in RFC 7541 accounting units
+// (name+value length + 32 per entry), of the per-connection dynamic
+// header table. ServerBinding.HeaderTableSize overrides it.
+const DefaultHeaderTableSize = 4096
+
+// headerStaticTable holds the indices for header names qrpc callers use
+// most: cmd metadata, tracing and auth. 1-indexed per RFC 7541 so index 0
+// always means "not in the static table".
+var headerStaticTable = []HeaderField{
+	{Name: ":cmd"},
+	{Name: "trace-id"},
+	{Name: "deadline"},
+	{Name: "authorization"},
+	{Name: "content-type"},
+}
+
+// HeaderField is a single decoded (name, value) pair.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// DynamicTable is a per-connection, size-bounded FIFO of header fields
+// seen on the wire, used to back-reference repeated headers the way
+// RFC 7541's dynamic table does. Entries are evicted oldest-first once
+// MaxSize is exceeded.
+type DynamicTable struct {
+	entries []HeaderField // most-recently-added last
+	size    int
+	MaxSize int
+}
+
+// NewDynamicTable creates a table bounded at maxSize accounting units.
+func NewDynamicTable(maxSize int) *DynamicTable {
+	if maxSize <= 0 {
+		maxSize = DefaultHeaderTableSize
+	}
+	return &DynamicTable{MaxSize: maxSize}
+}
+
+func entrySize(f HeaderField) int {
+	// RFC 7541 4.1: 32 bytes of overhead per entry on top of the
+	// name/value octets.
+	return len(f.Name) + len(f.Value) + 32
+}
+
+// Add inserts f, evicting the oldest entries until the table fits within
+// MaxSize.
+func (dt *DynamicTable) Add(f HeaderField) {
+	dt.entries = append(dt.entries, f)
+	dt.size += entrySize(f)
+
+	for dt.size > dt.MaxSize && len(dt.entries) > 0 {
+		dt.size -= entrySize(dt.entries[0])
+		dt.entries = dt.entries[1:]
+	}
+}
+
+// get returns the field at a 1-based combined index: 1..len(static) is
+// the static table, the rest is the dynamic table, most-recent first.
+func (dt *DynamicTable) get(index int) (HeaderField, bool) {
+	if index < 1 {
+		return HeaderField{}, false
+	}
+	if index <= len(headerStaticTable) {
+		return headerStaticTable[index-1], true
+	}
+
+	di := index - len(headerStaticTable) - 1
+	if di >= len(dt.entries) {
+		return HeaderField{}, false
+	}
+	return dt.entries[len(dt.entries)-1-di], true
+}
+
+// find looks for an exact (name, value) match, falling back to a
+// name-only match, across the static then dynamic table. nameOnly
+// reports whether only the name matched.
+func (dt *DynamicTable) find(name, value string) (index int, nameOnly bool) {
+	nameIdx := 0
+	for i, f := range headerStaticTable {
+		if f.Name == name {
+			if nameIdx == 0 {
+				nameIdx = i + 1
+			}
+		}
+	}
+	for i := len(dt.entries) - 1; i >= 0; i-- {
+		f := dt.entries[i]
+		if f.Name == name && f.Value == value {
+			return len(headerStaticTable) + (len(dt.entries) - i), false
+		}
+		if f.Name == name && nameIdx == 0 {
+			nameIdx = len(headerStaticTable) + (len(dt.entries) - i)
+		}
+	}
+	if nameIdx != 0 {
+		return nameIdx, true
+	}
+	return 0, false
+}
+
+// encodeInt encodes value using the RFC 7541 section 5.1 prefix-integer
+// scheme: the low prefixBits bits of the first byte (already containing
+// the representation's leading bits) hold small values directly, larger
+// values continue in base-128 varint bytes.
+func encodeInt(buf *bytes.Buffer, firstByte byte, prefixBits uint, value uint64) {
+	max := uint64(1)<<prefixBits - 1
+	if value < max {
+		buf.WriteByte(firstByte | byte(value))
+		return
+	}
+
+	buf.WriteByte(firstByte | byte(max))
+	value -= max
+	for value >= 0x80 {
+		buf.WriteByte(byte(value&0x7f) | 0x80)
+		value >>= 7
+	}
+	buf.WriteByte(byte(value))
+}
+
+func decodeInt(data []byte, prefixBits uint) (value uint64, consumed int, err error) {
+	if len(data) == 0 {
+		return 0, 0, ErrInvalidHeaderBlock
+	}
+
+	max := uint64(1)<<prefixBits - 1
+	value = uint64(data[0]) & max
+	if value < max {
+		return value, 1, nil
+	}
+
+	shift := uint(0)
+	for i := 1; i < len(data); i++ {
+		b := data[i]
+		value += uint64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, ErrInvalidHeaderBlock
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	encodeInt(buf, 0, 7, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func decodeString(data []byte) (s string, consumed int, err error) {
+	length, n, err := decodeInt(data, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	data = data[n:]
+	if uint64(len(data)) < length {
+		return "", 0, ErrInvalidHeaderBlock
+	}
+	return string(data[:length]), n + int(length), nil
+}
+
+// EncodeHeaderBlock serializes fields against dt, growing dt with any
+// field not already indexable so later header blocks on the same
+// connection can reference it. Representations follow RFC 7541 section 6:
+// indexed (1xxxxxxx), literal with incremental indexing (01xxxxxxx), and
+// literal without indexing (0000xxxx).
+func EncodeHeaderBlock(dt *DynamicTable, fields []HeaderField) []byte {
+	var buf bytes.Buffer
+
+	for _, f := range fields {
+		index, nameOnly := dt.find(f.Name, f.Value)
+
+		if index != 0 && !nameOnly {
+			encodeInt(&buf, 0x80, 7, uint64(index))
+			continue
+		}
+
+		if index != 0 {
+			encodeInt(&buf, 0x40, 6, uint64(index))
+		} else {
+			encodeInt(&buf, 0x40, 6, 0)
+			encodeString(&buf, f.Name)
+		}
+		encodeString(&buf, f.Value)
+		dt.Add(f)
+	}
+
+	return buf.Bytes()
+}
+
+// DecodeHeaderBlock is the inverse of EncodeHeaderBlock, updating dt the
+// same way the encoder did so both sides' dynamic tables stay in sync.
+func DecodeHeaderBlock(dt *DynamicTable, data []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+
+	for len(data) > 0 {
+		b := data[0]
+		switch {
+		case b&0x80 != 0: // indexed
+			index, n, err := decodeInt(data, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, ok := dt.get(int(index))
+			if !ok {
+				return nil, ErrInvalidHeaderBlock
+			}
+			fields = append(fields, f)
+			data = data[n:]
+
+		case b&0xc0 == 0x40: // literal with incremental indexing
+			index, n, err := decodeInt(data, 6)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+
+			var name string
+			if index != 0 {
+				existing, ok := dt.get(int(index))
+				if !ok {
+					return nil, ErrInvalidHeaderBlock
+				}
+				name = existing.Name
+			} else {
+				name, n, err = decodeString(data)
+				if err != nil {
+					return nil, err
+				}
+				data = data[n:]
+			}
+
+			value, n, err := decodeString(data)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+
+			f := HeaderField{Name: name, Value: value}
+			fields = append(fields, f)
+			dt.Add(f)
+
+		default: // literal without indexing
+			index, n, err := decodeInt(data, 4)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+
+			var name string
+			if index != 0 {
+				existing, ok := dt.get(int(index))
+				if !ok {
+					return nil, ErrInvalidHeaderBlock
+				}
+				name = existing.Name
+			} else {
+				name, n, err = decodeString(data)
+				if err != nil {
+					return nil, err
+				}
+				data = data[n:]
+			}
+
+			value, n, err := decodeString(data)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+
+			fields = append(fields, HeaderField{Name: name, Value: value})
+		}
+	}
+
+	return fields, nil
+}
+
+// frameHeaderLenSize is the width, in bytes, of the length prefix placed
+// before the header block on the wire when FlagHeader is set.
+const frameHeaderLenSize = 2
+
+func splitHeaderBlock(payload []byte) (headerBlock, rest []byte, err error) {
+	if len(payload) < frameHeaderLenSize {
+		return nil, nil, ErrInvalidHeaderBlock
+	}
+	n := binary.BigEndian.Uint16(payload)
+	payload = payload[frameHeaderLenSize:]
+	if int(n) > len(payload) {
+		return nil, nil, ErrInvalidHeaderBlock
+	}
+	return payload[:n], payload[n:], nil
+}
+
+// prependHeaderBlock is the write-side counterpart of splitHeaderBlock,
+// used by FrameWriter.EndWrite once WriteHeader calls have been buffered.
+func prependHeaderBlock(headerBlock, payload []byte) []byte {
+	out := make([]byte, frameHeaderLenSize+len(headerBlock)+len(payload))
+	binary.BigEndian.PutUint16(out, uint16(len(headerBlock)))
+	copy(out[frameHeaderLenSize:], headerBlock)
+	copy(out[frameHeaderLenSize+len(headerBlock):], payload)
+	return out
+}
+
+// frameHeaders holds the decoded header fields for frames that carried
+// FlagHeader, keyed by the Frame itself since Frame predates this feature
+// and has no room reserved for them. Populated by
+// defaultFrameReader.readFrame, read via Frame.Header.
+var frameHeaders sync.Map // map[*Frame]map[string]string
+
+// Header returns the decoded header fields for this frame, or nil if it
+// didn't carry any. Embedders of Frame (e.g. RequestFrame) get this for
+// free.
+func (f *Frame) Header() map[string]string {
+	v, ok := frameHeaders.Load(f)
+	if !ok {
+		return nil
+	}
+	return v.(map[string]string)
+}
@@ -0,0 +1,123 @@
+package qrpc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecodeIntRoundTrip(t *testing.T) {
+	cases := []struct {
+		prefixBits uint
+		value      uint64
+	}{
+		{7, 0},
+		{7, 1},
+		{7, 126},
+		{7, 127},
+		{7, 128},
+		{7, 1000},
+		{7, 1 << 20},
+		{6, 0},
+		{6, 62},
+		{6, 63},
+		{6, 1 << 16},
+		{4, 0},
+		{4, 14},
+		{4, 15},
+		{4, 1 << 10},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		encodeInt(&buf, 0, c.prefixBits, c.value)
+
+		got, consumed, err := decodeInt(buf.Bytes(), c.prefixBits)
+		if err != nil {
+			t.Fatalf("decodeInt(%d, prefix=%d): %v", c.value, c.prefixBits, err)
+		}
+		if got != c.value {
+			t.Errorf("decodeInt(%d, prefix=%d) = %d, want %d", c.value, c.prefixBits, got, c.value)
+		}
+		if consumed != buf.Len() {
+			t.Errorf("decodeInt(%d, prefix=%d) consumed %d bytes, want %d", c.value, c.prefixBits, consumed, buf.Len())
+		}
+	}
+}
+
+func TestDecodeIntTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	encodeInt(&buf, 0, 7, 1000)
+	truncated := buf.Bytes()[:1] // continuation byte missing
+
+	if _, _, err := decodeInt(truncated, 7); err == nil {
+		t.Error("decodeInt on truncated input: expected error, got nil")
+	}
+}
+
+func TestEncodeDecodeHeaderBlockRoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{Name: "authorization", Value: "Bearer token-1"},
+		{Name: "trace-id", Value: "abc123"},
+		{Name: "x-custom", Value: "first"},
+		// Repeats should hit the dynamic table on both sides.
+		{Name: "authorization", Value: "Bearer token-1"},
+		{Name: "x-custom", Value: "second"},
+	}
+
+	encDT := NewDynamicTable(0)
+	encoded := EncodeHeaderBlock(encDT, fields)
+
+	decDT := NewDynamicTable(0)
+	decoded, err := DecodeHeaderBlock(decDT, encoded)
+	if err != nil {
+		t.Fatalf("DecodeHeaderBlock: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, fields) {
+		t.Errorf("round trip mismatch:\n got  %#v\n want %#v", decoded, fields)
+	}
+}
+
+func TestDynamicTableEviction(t *testing.T) {
+	// Each entry costs len(name)+len(value)+32; pick a tiny MaxSize so the
+	// oldest entry is evicted once a second is added.
+	dt := NewDynamicTable(entrySize(HeaderField{Name: "k", Value: "v1"}) + 1)
+
+	dt.Add(HeaderField{Name: "k", Value: "v1"})
+	dt.Add(HeaderField{Name: "k", Value: "v2"})
+
+	if _, ok := dt.find("k", "v1"); ok {
+		t.Error("evicted entry v1 still found in dynamic table")
+	}
+	if idx, nameOnly := dt.find("k", "v2"); idx == 0 || nameOnly {
+		t.Errorf("find(k, v2) = (%d, %v), want a non-zero exact match", idx, nameOnly)
+	}
+}
+
+func TestSplitPrependHeaderBlockRoundTrip(t *testing.T) {
+	headerBlock := []byte{0x01, 0x02, 0x03}
+	payload := []byte("rest of the frame")
+
+	combined := prependHeaderBlock(headerBlock, payload)
+
+	gotBlock, gotRest, err := splitHeaderBlock(combined)
+	if err != nil {
+		t.Fatalf("splitHeaderBlock: %v", err)
+	}
+	if !bytes.Equal(gotBlock, headerBlock) {
+		t.Errorf("splitHeaderBlock headerBlock = %v, want %v", gotBlock, headerBlock)
+	}
+	if !bytes.Equal(gotRest, payload) {
+		t.Errorf("splitHeaderBlock rest = %v, want %v", gotRest, payload)
+	}
+}
+
+func TestSplitHeaderBlockInvalid(t *testing.T) {
+	if _, _, err := splitHeaderBlock([]byte{0x00}); err == nil {
+		t.Error("splitHeaderBlock on too-short payload: expected error, got nil")
+	}
+	if _, _, err := splitHeaderBlock([]byte{0x00, 0xff}); err == nil {
+		t.Error("splitHeaderBlock with length exceeding payload: expected error, got nil")
+	}
+}
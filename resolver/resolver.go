@@ -0,0 +1,213 @@
+// Package resolver defines the pluggable name resolution qrpc's client
+// uses to turn a target string such as "dns:///svc.local:8080" or
+// "static:///10.0.0.1:9000,10.0.0.2:9000" into a live set of addresses,
+// modeled on grpc-go's resolver package.
+package resolver
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address is a single resolved endpoint.
+type Address struct {
+	// Addr is dialable, e.g. "10.0.0.1:9000".
+	Addr string
+	// ServerName overrides the authority used for TLS verification, if set.
+	ServerName string
+	// Metadata carries resolver-specific data through to the balancer.
+	// The only convention a Builder in this package establishes is an
+	// int traffic weight (see staticBuilder's ";weight" address suffix);
+	// a balancer that doesn't expect weights may ignore Metadata or any
+	// other type it finds here.
+	Metadata interface{}
+}
+
+// State is a snapshot of the addresses a Resolver currently believes are
+// live for its target.
+type State struct {
+	Addresses []Address
+}
+
+// ClientConn is the subset of qrpc.ClientConn a Resolver needs: a sink
+// for address updates and resolution errors.
+type ClientConn interface {
+	UpdateState(State)
+	ReportError(error)
+}
+
+// Target is a parsed target string: scheme:///endpoint.
+type Target struct {
+	Scheme   string
+	Endpoint string
+}
+
+// BuildOptions carries extra context a Builder may need.
+type BuildOptions struct{}
+
+// Resolver watches a Target and pushes State updates to its ClientConn
+// until Close is called.
+type Resolver interface {
+	// ResolveNow is a best-effort hint to re-resolve immediately, e.g.
+	// after a connection failure.
+	ResolveNow()
+	Close()
+}
+
+// Builder creates a Resolver for a given scheme.
+type Builder interface {
+	Build(target Target, cc ClientConn, opts BuildOptions) (Resolver, error)
+	Scheme() string
+}
+
+// ErrUnknownScheme is returned by Get for an unregistered scheme.
+var ErrUnknownScheme = errors.New("resolver: unknown scheme")
+
+var (
+	mu       sync.RWMutex
+	builders = make(map[string]Builder)
+)
+
+// Register registers b under its Scheme(). Registering the same scheme
+// twice overwrites the previous Builder, matching grpc-go's behavior so
+// tests can swap in a fake resolver.
+func Register(b Builder) {
+	mu.Lock()
+	defer mu.Unlock()
+	builders[b.Scheme()] = b
+}
+
+// Get looks up the Builder registered for scheme.
+func Get(scheme string) (Builder, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	b, ok := builders[scheme]
+	if !ok {
+		return nil, ErrUnknownScheme
+	}
+	return b, nil
+}
+
+// ParseTarget splits "scheme:///endpoint" into a Target. A target with no
+// recognized scheme separator is treated as a bare "static" endpoint list,
+// so plain "host:port" targets keep working without a scheme prefix.
+func ParseTarget(target string) Target {
+	if idx := strings.Index(target, ":///"); idx >= 0 {
+		return Target{Scheme: target[:idx], Endpoint: target[idx+4:]}
+	}
+	return Target{Scheme: "static", Endpoint: target}
+}
+
+func init() {
+	Register(staticBuilder{})
+	Register(dnsBuilder{})
+}
+
+// staticBuilder implements the "static" scheme: a fixed, comma-separated
+// address list that never changes after the initial UpdateState. Each
+// entry may carry an optional ";weight" suffix, e.g.
+// "10.0.0.1:9000;3,10.0.0.2:9000" gives the first address 3x the traffic
+// share of the second; an omitted or invalid weight defaults to 1 and is
+// left out of Metadata entirely.
+type staticBuilder struct{}
+
+func (staticBuilder) Scheme() string { return "static" }
+
+func (staticBuilder) Build(target Target, cc ClientConn, _ BuildOptions) (Resolver, error) {
+	var addrs []Address
+	for _, a := range strings.Split(target.Endpoint, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		addr := Address{Addr: a}
+		if idx := strings.LastIndex(a, ";"); idx >= 0 {
+			if w, err := strconv.Atoi(a[idx+1:]); err == nil && w > 0 {
+				addr.Addr = a[:idx]
+				addr.Metadata = w
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	cc.UpdateState(State{Addresses: addrs})
+	return staticResolver{}, nil
+}
+
+type staticResolver struct{}
+
+func (staticResolver) ResolveNow() {}
+func (staticResolver) Close()      {}
+
+// dnsReResolveInterval is how often a dnsResolver re-runs net.LookupHost
+// on its own, on top of any caller-triggered ResolveNow, so a dns:///
+// target picks up DNS changes (scale-up, failover) without every caller
+// having to know to call ResolveNow itself.
+const dnsReResolveInterval = 30 * time.Second
+
+// dnsBuilder implements the "dns" scheme: endpoint is a "host:port" pair,
+// re-resolved via net.LookupHost whenever ResolveNow is called and every
+// dnsReResolveInterval in the background.
+type dnsBuilder struct{}
+
+func (dnsBuilder) Scheme() string { return "dns" }
+
+func (dnsBuilder) Build(target Target, cc ClientConn, _ BuildOptions) (Resolver, error) {
+	host, port, err := net.SplitHostPort(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &dnsResolver{host: host, port: port, cc: cc, closeCh: make(chan struct{})}
+	r.ResolveNow()
+	r.wg.Add(1)
+	go r.watch()
+	return r, nil
+}
+
+type dnsResolver struct {
+	host, port string
+	cc         ClientConn
+
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (r *dnsResolver) ResolveNow() {
+	ips, err := net.LookupHost(r.host)
+	if err != nil {
+		r.cc.ReportError(err)
+		return
+	}
+
+	addrs := make([]Address, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, Address{Addr: net.JoinHostPort(ip, r.port)})
+	}
+	r.cc.UpdateState(State{Addresses: addrs})
+}
+
+// watch re-resolves on a timer until Close stops it.
+func (r *dnsResolver) watch() {
+	defer r.wg.Done()
+
+	t := time.NewTicker(dnsReResolveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			r.ResolveNow()
+		case <-r.closeCh:
+			return
+		}
+	}
+}
+
+func (r *dnsResolver) Close() {
+	close(r.closeCh)
+	r.wg.Wait()
+}
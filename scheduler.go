@@ -0,0 +1,370 @@
+package qrpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStreamWeight is the priority weight (1-256) a stream gets when
+// FrameWriter.SetPriority was never called for it, matching HTTP/2's
+// default of 16.
+const DefaultStreamWeight uint8 = 16
+
+// DefaultWriteQuantum is the number of bytes of deficit a ready stream is
+// credited with per round of the write scheduler when
+// ServerBinding.WriteQuantum is 0. Scaled by a stream's weight relative
+// to DefaultStreamWeight, this is what turns weight into actual
+// bandwidth share.
+const DefaultWriteQuantum = 16 * 1024
+
+// streamPriority is the weight and optional parent dependency set via
+// FrameWriter.SetPriority, mirroring HTTP/2 stream priorities (RFC 7540
+// section 5.3): a stream's share of the connection is its weight over
+// the sum of its siblings' weights, and a stream depending on a parent
+// only competes for bandwidth once its parent has none left to use.
+type streamPriority struct {
+	weight   uint8
+	parentID uint64
+}
+
+// streamPriorities holds the priority set for a Stream, kept outside the
+// struct for the same reason as flowWindow/recvWindow in flowcontrol.go:
+// Stream predates this feature and has no field reserved for it. Missing
+// entries mean DefaultStreamWeight with no parent.
+var streamPriorities sync.Map // map[*Stream]streamPriority
+
+// SetStreamPriority records weight and parentRequestID for the stream
+// requestID owns on cs. A FrameWriter's SetPriority implementation calls
+// this between StartWrite and EndWrite, the same way WriteHeader buffers
+// against the in-flight frame; weight 0 is treated as
+// DefaultStreamWeight. parentRequestID of 0 means the stream has no
+// dependency and competes for bandwidth at the top level. Per RFC 7540
+// section 5.3.1, a stream cannot depend on itself, whether directly or
+// through a chain of other dependencies; dependsOnLocked rejects that by
+// falling back to no dependency rather than risking hasReadyParentLocked
+// deadlocking a cycle of streams against each other forever.
+func SetStreamPriority(cs *ConnStreams, requestID uint64, weight uint8, parentRequestID uint64) {
+	if weight == 0 {
+		weight = DefaultStreamWeight
+	}
+	s := cs.GetStream(requestID, 0)
+	if s == nil {
+		return
+	}
+	trackStream(cs, s)
+
+	// priorityMu makes the cycle check and the Store it guards atomic
+	// with respect to other SetStreamPriority calls on the same
+	// connection: two streams racing to depend on each other could
+	// otherwise both pass dependsOn before either Store lands.
+	priorityMu.Lock()
+	defer priorityMu.Unlock()
+	if parentRequestID != 0 && dependsOn(cs, parentRequestID, requestID) {
+		parentRequestID = 0
+	}
+	streamPriorities.Store(s, streamPriority{weight: weight, parentID: parentRequestID})
+}
+
+// priorityMu serializes SetStreamPriority's cycle check against its
+// store; streamPriorities is a sync.Map so concurrent reads/writes to
+// different streams stay lock-free everywhere else.
+var priorityMu sync.Mutex
+
+// dependsOn reports whether requestID appears in the dependency chain
+// starting at startRequestID, i.e. whether giving startRequestID a
+// parent of requestID would close a cycle (startRequestID == requestID
+// is the direct self-dependency case, caught on the chain's first step).
+// A chain already visited is cut short defensively rather than walked
+// twice, in case one somehow already exists.
+func dependsOn(cs *ConnStreams, startRequestID, requestID uint64) bool {
+	visited := make(map[uint64]bool)
+	cur := startRequestID
+	for cur != 0 {
+		if cur == requestID || visited[cur] {
+			return true
+		}
+		visited[cur] = true
+
+		parent := cs.GetStream(cur, 0)
+		if parent == nil {
+			return false
+		}
+		v, ok := streamPriorities.Load(parent)
+		if !ok {
+			return false
+		}
+		cur = v.(streamPriority).parentID
+	}
+	return false
+}
+
+// deficitIncrement is the pure arithmetic behind next()'s deficit round
+// robin: a DefaultStreamWeight stream is credited quantum bytes per
+// round, and every other weight scales proportionally to it.
+func deficitIncrement(quantum int, weight uint8) int {
+	return quantum * int(weight) / int(DefaultStreamWeight)
+}
+
+func streamWeight(s *Stream) uint8 {
+	v, ok := streamPriorities.Load(s)
+	if !ok {
+		return DefaultStreamWeight
+	}
+	return v.(streamPriority).weight
+}
+
+// streamMetrics accumulates the bytes-sent and blocked-time counters a
+// writeScheduler maintains per stream, kept in the same side-table style
+// as streamPriorities. Blocked time is time a stream spent with a frame
+// ready to send but skipped, either for lack of deficit or because its
+// flow-control window was empty.
+type streamMetrics struct {
+	bytesSent   uint64 // atomic
+	blockedNano int64  // atomic, time.Duration
+}
+
+var streamMetricsTable sync.Map // map[*Stream]*streamMetrics
+
+func metricsFor(s *Stream) *streamMetrics {
+	v, _ := streamMetricsTable.LoadOrStore(s, &streamMetrics{})
+	return v.(*streamMetrics)
+}
+
+// StreamBytesSent returns the number of payload bytes the write
+// scheduler has put on the wire for s so far.
+func StreamBytesSent(s *Stream) uint64 {
+	return atomic.LoadUint64(&metricsFor(s).bytesSent)
+}
+
+// StreamBlockedTime returns the cumulative time s has spent with a frame
+// queued but not yet scheduled, whether due to losing out to
+// higher-weight siblings or waiting on its flow-control window.
+func StreamBlockedTime(s *Stream) time.Duration {
+	return time.Duration(atomic.LoadInt64(&metricsFor(s).blockedNano))
+}
+
+// pendingFrame is one frame queued for a stream, waiting for the
+// scheduler to grant it a turn.
+type pendingFrame struct {
+	frame    *Frame
+	flags    FrameFlag
+	queuedAt time.Time
+}
+
+// streamQueue is a single stream's share of a writeScheduler: its
+// pending frames in send order plus the deficit counter deficit round
+// robin uses to turn weight into bandwidth.
+type streamQueue struct {
+	stream  *Stream
+	pending []pendingFrame
+	deficit int
+}
+
+// writeScheduler replaces the implicit FIFO order frames would otherwise
+// leave writeFrameCh in with deficit-weighted round robin over the
+// streams that currently have something to send: every round each ready
+// stream's deficit grows by quantum*weight/DefaultStreamWeight, and a
+// stream may send queued frames as long as its deficit covers their size
+// and its flow-control windows (see AcquireSendWindow) allow it. A
+// stream whose parent (see SetStreamPriority) still has frames ready is
+// skipped in favour of the parent, same as HTTP/2 priority dependencies.
+// One is created per connection alongside its ConnStreams.
+type writeScheduler struct {
+	cs      *ConnStreams
+	quantum int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[uint64]*streamQueue // keyed by requestID
+	order  []uint64                // round-robin visiting order
+	closed bool
+}
+
+// newWriteScheduler creates a scheduler for cs. quantum is the deficit a
+// DefaultStreamWeight stream is credited per round; callers pass
+// ServerBinding.WriteQuantum or fall back to DefaultWriteQuantum.
+func newWriteScheduler(cs *ConnStreams, quantum int) *writeScheduler {
+	if quantum <= 0 {
+		quantum = DefaultWriteQuantum
+	}
+	ws := &writeScheduler{cs: cs, quantum: quantum, queues: make(map[uint64]*streamQueue)}
+	ws.cond = sync.NewCond(&ws.mu)
+	return ws
+}
+
+// Enqueue queues frame for s, to be scheduled for writing in a later
+// round. Called in place of a direct send on writeFrameCh.
+func (ws *writeScheduler) Enqueue(s *Stream, requestID uint64, frame *Frame, flags FrameFlag) {
+	trackStream(ws.cs, s)
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	q, ok := ws.queues[requestID]
+	if !ok {
+		q = &streamQueue{stream: s}
+		ws.queues[requestID] = q
+		ws.order = append(ws.order, requestID)
+	}
+	q.pending = append(q.pending, pendingFrame{frame: frame, flags: flags, queuedAt: time.Now()})
+	ws.cond.Broadcast()
+}
+
+// Close unblocks a goroutine parked in run, e.g. on connection teardown.
+func (ws *writeScheduler) Close() {
+	ws.mu.Lock()
+	ws.closed = true
+	ws.mu.Unlock()
+	ws.cond.Broadcast()
+}
+
+// blockedWaitTimeout bounds how long next() waits on ws.cond when every
+// ready stream turned out to be window-blocked, so a connection whose
+// sole stream is stalled on flow control still wakes up periodically to
+// re-check TryAcquireSendWindow instead of sleeping until the next
+// Enqueue/Close, which a WINDOW_UPDATE arriving on the read side never
+// signals directly.
+const blockedWaitTimeout = time.Millisecond
+
+// run drives the scheduler until Close is called, handing each granted
+// frame to write. It never returns an error itself; write's errors are
+// the caller's to surface, e.g. by tearing down the connection.
+func (ws *writeScheduler) run(write func(*Stream, *Frame, FrameFlag) error) {
+	for {
+		requestID, q, pf, ok := ws.next()
+		if !ok {
+			return
+		}
+
+		n := len(pf.frame.Payload)
+
+		if err := write(q.stream, pf.frame, pf.flags); err != nil {
+			return
+		}
+
+		m := metricsFor(q.stream)
+		atomic.AddUint64(&m.bytesSent, uint64(n))
+
+		ws.mu.Lock()
+		q.pending = q.pending[1:]
+		q.deficit -= n
+		if len(q.pending) == 0 {
+			delete(ws.queues, requestID)
+			ws.removeFromOrderLocked(requestID)
+		}
+		ws.mu.Unlock()
+	}
+}
+
+// next blocks until a stream is ready to send right now — has a pending
+// frame, deficit enough to cover it, no ready parent ahead of it, and
+// room in its flow-control windows — and returns its queue and head
+// frame (copied out under ws.mu, since Enqueue can reallocate
+// q.pending's backing array concurrently), or reports ok=false once the
+// scheduler is closed with nothing left to send. A stream that is ready
+// in every respect except its flow-control window is skipped in favour
+// of the next one instead of stalling the whole connection behind it
+// (see TryAcquireSendWindow); if every ready stream turns out blocked
+// this way, next() waits no longer than blockedWaitTimeout before
+// sweeping again.
+func (ws *writeScheduler) next() (requestID uint64, q *streamQueue, pf pendingFrame, ok bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for {
+		sawBlocked := false
+
+		for i := 0; i < len(ws.order); i++ {
+			requestID = ws.order[0]
+			ws.order = append(ws.order[1:], requestID)
+
+			q = ws.queues[requestID]
+			if q == nil || len(q.pending) == 0 {
+				continue
+			}
+			if ws.hasReadyParentLocked(q.stream) {
+				continue
+			}
+
+			// Only grant more deficit while the head frame can't yet
+			// afford it; once it can, stop accruing so a stream stuck
+			// behind a closed flow-control window doesn't pile up an
+			// oversized deficit it then bursts through once its window
+			// reopens.
+			pending := q.pending[0]
+			if q.deficit < len(pending.frame.Payload) {
+				q.deficit += deficitIncrement(ws.quantum, streamWeight(q.stream))
+				if q.deficit < len(pending.frame.Payload) {
+					// Still short: without marking this a "blocked"
+					// sweep, a single frame whose size exceeds one
+					// quantum's worth of deficit would have had no
+					// other way to re-trigger accrual once every
+					// other stream drains, and next() would park in
+					// the untimed ws.cond.Wait() below forever.
+					sawBlocked = true
+					continue
+				}
+			}
+
+			if !TryAcquireSendWindow(ws.cs, q.stream, len(pending.frame.Payload)) {
+				ws.recordBlocked(q.stream, pending.queuedAt)
+				sawBlocked = true
+				continue
+			}
+
+			return requestID, q, pending, true
+		}
+
+		if ws.closed && len(ws.order) == 0 {
+			return 0, nil, pendingFrame{}, false
+		}
+		if sawBlocked {
+			ws.waitTimeoutLocked(blockedWaitTimeout)
+			continue
+		}
+		ws.cond.Wait()
+	}
+}
+
+// waitTimeoutLocked is sync.Cond.Wait bounded by d: it releases ws.mu,
+// waits for either a broadcast or d to elapse, and re-acquires ws.mu
+// before returning, same as Wait's contract.
+func (ws *writeScheduler) waitTimeoutLocked(d time.Duration) {
+	timer := time.AfterFunc(d, func() {
+		ws.mu.Lock()
+		ws.cond.Broadcast()
+		ws.mu.Unlock()
+	})
+	defer timer.Stop()
+	ws.cond.Wait()
+}
+
+// hasReadyParentLocked reports whether s depends on a parent stream that
+// itself has a frame ready to send, in which case s must wait its turn
+// behind that parent per RFC 7540 section 5.3.
+func (ws *writeScheduler) hasReadyParentLocked(s *Stream) bool {
+	v, ok := streamPriorities.Load(s)
+	if !ok || v.(streamPriority).parentID == 0 {
+		return false
+	}
+	parent, ok := ws.queues[v.(streamPriority).parentID]
+	return ok && len(parent.pending) > 0
+}
+
+func (ws *writeScheduler) removeFromOrderLocked(requestID uint64) {
+	for i, id := range ws.order {
+		if id == requestID {
+			ws.order = append(ws.order[:i], ws.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// recordBlocked accounts for time a frame spent queued without being
+// sent, either for lack of deficit this round or a closed flow-control
+// window, and re-queues it behind the scheduler's other work.
+func (ws *writeScheduler) recordBlocked(s *Stream, since time.Time) {
+	m := metricsFor(s)
+	atomic.AddInt64(&m.blockedNano, int64(time.Since(since)))
+}
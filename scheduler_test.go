@@ -0,0 +1,41 @@
+package qrpc
+
+import "testing"
+
+// writeScheduler's actual fairness/priority behavior (newWriteScheduler,
+// Enqueue, next, run) all operate on *ConnStreams/*Stream/*Frame, which
+// this source tree only ever references, never defines (see
+// framereader.go, server.go) — they can't be constructed here, so this
+// only covers the pure deficit-round-robin arithmetic those methods lean
+// on.
+func TestDeficitIncrementScalesWithWeight(t *testing.T) {
+	cases := []struct {
+		quantum int
+		weight  uint8
+		want    int
+	}{
+		{16 * 1024, DefaultStreamWeight, 16 * 1024},
+		{16 * 1024, DefaultStreamWeight * 2, 32 * 1024},
+		{16 * 1024, DefaultStreamWeight / 2, 8 * 1024},
+		{1000, 1, 1000 / int(DefaultStreamWeight)},
+	}
+
+	for _, c := range cases {
+		got := deficitIncrement(c.quantum, c.weight)
+		if got != c.want {
+			t.Errorf("deficitIncrement(%d, %d) = %d, want %d", c.quantum, c.weight, got, c.want)
+		}
+	}
+}
+
+func TestDeficitIncrementHigherWeightGetsMore(t *testing.T) {
+	low := deficitIncrement(16*1024, DefaultStreamWeight)
+	high := deficitIncrement(16*1024, DefaultStreamWeight*4)
+
+	if high <= low {
+		t.Errorf("deficitIncrement with 4x weight = %d, want > %d", high, low)
+	}
+	if high != low*4 {
+		t.Errorf("deficitIncrement with 4x weight = %d, want exactly %d", high, low*4)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/liexusong/qrpc/credentials"
+	"github.com/liexusong/qrpc/stats"
 	"github.com/oklog/run"
 	"go.uber.org/ratelimit"
 )
@@ -25,8 +27,10 @@ var (
 // but it internally needs be scheduled, thus maintains a simple yet powerful interface
 type FrameWriter interface {
 	StartWrite(requestID uint64, cmd Cmd, flags FrameFlag)
-	WriteBytes(v []byte) // v is copied in WriteBytes
-	EndWrite() error     // block until scheduled
+	WriteHeader(name, value string)                   // must be called after StartWrite and before WriteBytes
+	SetPriority(weight uint8, parentRequestID uint64) // must be called after StartWrite and before EndWrite
+	WriteBytes(v []byte)                              // v is copied in WriteBytes
+	EndWrite() error                                  // block until scheduled
 
 	ResetFrame(requestID uint64, reason Cmd) error
 }
@@ -50,6 +54,35 @@ func (f HandlerFunc) ServeQRPC(w FrameWriter, r *RequestFrame) {
 // MiddlewareFunc will return false to abort
 type MiddlewareFunc func(FrameWriter, *RequestFrame) bool
 
+// rpcStatsContext is the stats.Handlers a connection was accepted with,
+// plus the ctx they were tagged against in newConn, kept per-stream so
+// ServeMux.ServeQRPC and the write loop in newConn — which only see a
+// *RequestFrame/*FrameWriter or a bare *Stream, not the serveconn/
+// defaultFrameReader that set this up — can still fire Begin/OutPayload/
+// End, symmetric with subConn.call on the client.
+type rpcStatsContext struct {
+	handlers stats.Handlers
+	ctx      context.Context
+}
+
+// streamStats holds rpcStatsContext keyed by the owning Stream, kept
+// outside the struct for the same reason as flowcontrol.go's
+// streamWindows. Populated once per stream by defaultFrameReader.ReadFrame
+// on first bind; released by ConnStreams.Cleanup along with the other
+// stream-keyed side-tables (see trackStream).
+var streamStats sync.Map // map[*Stream]*rpcStatsContext
+
+// loadRPCStats looks up the rpcStatsContext ReadFrame recorded for s, if
+// any — a connection dialed/accepted with no stats.Handler configured
+// never gets an entry, same as a nil stats.Handlers no-ops on HandleRPC.
+func loadRPCStats(s *Stream) (*rpcStatsContext, bool) {
+	v, ok := streamStats.Load(s)
+	if !ok {
+		return nil, false
+	}
+	return v.(*rpcStatsContext), true
+}
+
 // ServeMux is qrpc request multiplexer.
 type ServeMux struct {
 	mu sync.RWMutex
@@ -94,7 +127,27 @@ func (mux *ServeMux) ServeQRPC(w FrameWriter, r *RequestFrame) {
 		return
 	}
 	mux.mu.RUnlock()
+
+	// rc is populated by defaultFrameReader.ReadFrame when it first binds
+	// r.stream to the connection it was read from (see trackStream there);
+	// symmetric with subConn.call's Begin/End bracket on the client.
+	rc, hasStats := loadRPCStats(r.stream)
+	begin := time.Now()
+	if hasStats {
+		rc.handlers.HandleRPC(rc.ctx, stats.Begin{Cmd: uint32(r.Cmd), RequestID: r.RequestID, BeginTime: begin})
+		defer func() {
+			var err error
+			if p := recover(); p != nil {
+				err = fmt.Errorf("qrpc: handler panic: %v", p)
+				rc.handlers.HandleRPC(rc.ctx, stats.End{RequestID: r.RequestID, Error: err, Duration: time.Since(begin)})
+				panic(p)
+			}
+			rc.handlers.HandleRPC(rc.ctx, stats.End{RequestID: r.RequestID, Duration: time.Since(begin)})
+		}()
+	}
+
 	h.ServeQRPC(w, r)
+	r.AutoConsume()
 }
 
 // Server defines parameters for running an qrpc server.
@@ -273,7 +326,17 @@ func (srv *Server) Serve(qrpcListener Listener, idx int) error {
 		tempDelay = 0
 
 		GoFunc(&srv.wg, func() {
-			c := srv.newConn(serveCtx, rw, idx)
+			conn, authInfo := rw, credentials.AuthInfo(nil)
+			if creds := srv.bindings[idx].Creds; creds != nil {
+				var err error
+				conn, authInfo, err = creds.ServerHandshake(conn)
+				if err != nil {
+					LogError("qrpc: ServerHandshake failed", "err", err)
+					return
+				}
+			}
+
+			c := srv.newConn(serveCtx, conn, idx, authInfo)
 			c.serve()
 		})
 	}
@@ -323,8 +386,9 @@ func (srv *Server) trackListener(ln net.Listener, add bool) {
 	}
 }
 
-// Create new connection from rwc.
-func (srv *Server) newConn(ctx context.Context, rwc net.Conn, idx int) (sc *serveconn) {
+// Create new connection from rwc. authInfo is the verified peer identity
+// produced by the binding's TransportCredentials, or nil if it has none.
+func (srv *Server) newConn(ctx context.Context, rwc net.Conn, idx int, authInfo credentials.AuthInfo) (sc *serveconn) {
 	if srv.bindings[idx].ReadFrameChSize > 0 {
 		sc = &serveconn{
 			server:       srv,
@@ -346,11 +410,63 @@ func (srv *Server) newConn(ctx context.Context, rwc net.Conn, idx int) (sc *serv
 	}
 
 	ctx, cancelCtx := context.WithCancel(ctx)
-	ctx = context.WithValue(ctx, ConnectionInfoKey, &ConnectionInfo{SC: sc})
+	ctx = context.WithValue(ctx, ConnectionInfoKey, &ConnectionInfo{SC: sc, AuthInfo: authInfo})
+
+	if sh := srv.bindings[idx].Stats; sh != nil {
+		ctx = sh.TagConn(ctx, &stats.ConnTagInfo{
+			RemoteAddr: rwc.RemoteAddr().String(),
+			LocalAddr:  rwc.LocalAddr().String(),
+		})
+		sh.HandleConn(ctx, stats.ConnBegin{})
+	}
 
 	sc.cancelCtx = cancelCtx
 	sc.ctx = ctx
 
+	// Announce this side's initial connection-wide send window before any
+	// data frame goes out, so the peer's ApplyInitialWindow (see
+	// flowcontrol.go) has something to apply. The peer does the same on
+	// its own SETTINGS frame, read by defaultFrameReader.ReadFrame.
+	initialWindow := srv.bindings[idx].InitialConnWindowSize
+	if initialWindow == 0 {
+		initialWindow = DefaultInitialWindowSize
+	}
+	if err := writeFrame(rwc, 0, CmdSettings, 0, EncodeWindowUpdate(uint32(initialWindow))); err != nil {
+		LogError("qrpc: write SETTINGS failed", "err", err)
+	}
+
+	// The scheduler sits in front of writeFrameCh: StartWrite/EndWrite
+	// enqueue onto it instead of sending directly, and this goroutine is
+	// what actually feeds writeFrameCh, now in weighted-priority order
+	// rather than call order. It shuts down once Close empties its
+	// queues from serveconn's teardown path.
+	sc.scheduler = newWriteScheduler(sc.cs, srv.bindings[idx].WriteQuantum)
+	GoFunc(&srv.wg, func() {
+		sc.scheduler.run(func(s *Stream, f *Frame, flags FrameFlag) error {
+			sc.writeFrameCh <- writeFrameRequest{Frame: f, Flags: flags}
+
+			// This is the other end of FrameWriter.EndWrite's "block
+			// until scheduled": the frame has now actually been handed
+			// to the connection's write loop, same point OutPayload is
+			// fired from on the client (see subConn.call).
+			if rc, ok := loadRPCStats(s); ok {
+				// f.Payload already has any header block EndWrite
+				// prepended (see prependHeaderBlock); strip it back off
+				// so Length reports the application payload the same
+				// way subConn.call's client-side OutPayload does.
+				length := len(f.Payload)
+				if flags.HasHeaders() {
+					if _, rest, err := splitHeaderBlock(f.Payload); err == nil {
+						length = len(rest)
+					}
+				}
+				op := stats.OutPayload{RequestID: f.RequestID, Length: length, WireLength: 16 + len(f.Payload), SentTime: time.Now()}
+				rc.handlers.HandleRPC(rc.ctx, op)
+			}
+			return nil
+		})
+	})
+
 	srv.activeConn[idx].Store(sc, struct{}{})
 
 	return sc
@@ -383,12 +499,7 @@ check:
 			if opErr, ok := err.(*net.OpError); ok {
 				err = opErr.Err
 			}
-		}
-
-		if srv.bindings[idx].CounterMetric != nil {
-			errStr := fmt.Sprintf("%v", err)
-			countlvs := []string{"method", "kickoff", "error", errStr}
-			srv.bindings[idx].CounterMetric.With(countlvs...).Add(1)
+			LogError("qrpc: kickoff close", "err", err)
 		}
 
 		atomic.AddUint64(&kickOrder, 1)
@@ -420,6 +531,14 @@ func (srv *Server) untrack(sc *serveconn, kicked bool) (bool, <-chan struct{}) {
 			srv.bindings[idx].OnKickCB(sc.GetWriter())
 		}
 	}
+
+	if sh := srv.bindings[idx].Stats; sh != nil {
+		sh.HandleConn(sc.ctx, stats.ConnEnd{})
+	}
+
+	sc.scheduler.Close()
+	sc.cs.Cleanup()
+
 	close(sc.untrackedCh)
 	return true, sc.untrackedCh
 }
@@ -0,0 +1,154 @@
+// Package stats defines a handler interface for observing connection and
+// RPC lifecycle events on both the qrpc server and client, modeled on
+// grpc-go's stats.Handler. It carries no dependency on qrpc's root
+// package so Prometheus/OpenTelemetry/custom sinks can be written against
+// it without pulling in the rest of qrpc.
+package stats
+
+import (
+	"context"
+	"time"
+)
+
+// RPCStats is implemented by every per-RPC event type: Begin, InHeader,
+// InPayload, OutPayload and End.
+type RPCStats interface {
+	// IsClient reports whether this event was recorded on the client
+	// (true) or server (false) side of the RPC.
+	IsClient() bool
+}
+
+// ConnStats is implemented by every per-connection event type: ConnBegin
+// and ConnEnd.
+type ConnStats interface {
+	IsClient() bool
+}
+
+type statsBase struct{ Client bool }
+
+func (s statsBase) IsClient() bool { return s.Client }
+
+// Begin is recorded when an RPC starts, before any frame is sent/received.
+type Begin struct {
+	statsBase
+	Cmd       uint32
+	RequestID uint64
+	BeginTime time.Time
+}
+
+// InHeader is recorded when the header block of an incoming frame has
+// been decoded.
+type InHeader struct {
+	statsBase
+	RequestID uint64
+	Header    map[string]string
+}
+
+// InPayload is recorded once an incoming frame's payload has been fully
+// read.
+type InPayload struct {
+	statsBase
+	RequestID  uint64
+	Length     int // decoded payload length
+	WireLength int // bytes actually read off the wire for this frame
+	RecvTime   time.Time
+}
+
+// OutPayload is recorded once an outgoing frame has been handed to the
+// connection's write loop.
+type OutPayload struct {
+	statsBase
+	RequestID  uint64
+	Length     int
+	WireLength int
+	SentTime   time.Time
+}
+
+// End is recorded when an RPC finishes, successfully or not.
+type End struct {
+	statsBase
+	RequestID uint64
+	Error     error
+	Duration  time.Duration
+}
+
+// ConnBegin is recorded right after a connection is accepted/dialed.
+type ConnBegin struct{ statsBase }
+
+// ConnEnd is recorded once a connection is fully torn down.
+type ConnEnd struct{ statsBase }
+
+// connCtxKey / rpcCtxKey let a Handler stash per-connection/per-RPC state
+// (e.g. a trace span) in the context it gets back from TagConn/TagRPC.
+type ctxKey int
+
+const (
+	connCtxKey ctxKey = iota
+	rpcCtxKey
+)
+
+// Handler is implemented by anything that wants to observe connection and
+// RPC lifecycle events: latency histograms, byte counters, distributed
+// tracing spans, etc. Multiple Handlers can be attached; qrpc fans out to
+// each in registration order.
+type Handler interface {
+	// TagConn can attach connection-scoped data to ctx before HandleConn
+	// events for this connection are reported.
+	TagConn(ctx context.Context, info *ConnTagInfo) context.Context
+	// HandleConn processes a ConnBegin/ConnEnd event.
+	HandleConn(ctx context.Context, stats ConnStats)
+
+	// TagRPC can attach RPC-scoped data to ctx before HandleRPC events
+	// for this RPC are reported.
+	TagRPC(ctx context.Context, info *RPCTagInfo) context.Context
+	// HandleRPC processes a Begin/InHeader/InPayload/OutPayload/End event.
+	HandleRPC(ctx context.Context, stats RPCStats)
+}
+
+// ConnTagInfo is passed to Handler.TagConn.
+type ConnTagInfo struct {
+	RemoteAddr string
+	LocalAddr  string
+}
+
+// RPCTagInfo is passed to Handler.TagRPC.
+type RPCTagInfo struct {
+	Cmd       uint32
+	RequestID uint64
+}
+
+// Handlers fans an event out to a slice of Handler, treating a nil/empty
+// slice as a no-op so call sites don't need to check length themselves.
+type Handlers []Handler
+
+// TagConn calls TagConn on every handler in order, threading ctx through
+// each so later handlers see earlier ones' tags.
+func (hs Handlers) TagConn(ctx context.Context, info *ConnTagInfo) context.Context {
+	for _, h := range hs {
+		ctx = h.TagConn(ctx, info)
+	}
+	return ctx
+}
+
+// HandleConn fans out a ConnStats event to every handler.
+func (hs Handlers) HandleConn(ctx context.Context, s ConnStats) {
+	for _, h := range hs {
+		h.HandleConn(ctx, s)
+	}
+}
+
+// TagRPC calls TagRPC on every handler in order, threading ctx through
+// each so later handlers see earlier ones' tags.
+func (hs Handlers) TagRPC(ctx context.Context, info *RPCTagInfo) context.Context {
+	for _, h := range hs {
+		ctx = h.TagRPC(ctx, info)
+	}
+	return ctx
+}
+
+// HandleRPC fans out an RPCStats event to every handler.
+func (hs Handlers) HandleRPC(ctx context.Context, s RPCStats) {
+	for _, h := range hs {
+		h.HandleRPC(ctx, s)
+	}
+}